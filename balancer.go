@@ -0,0 +1,66 @@
+package srv
+
+import (
+	"math/rand"
+)
+
+//The view of one endpoint given to the balancer
+type EndpointStat struct {
+	Name string
+	//resources checked out or being created
+	Busy int
+	//idle resources
+	Idle int
+}
+
+//Choose the endpoint a new resource of the key is created by,
+//the idle resources are reused before any is created
+type Balancer interface {
+	//Return the position in eps of the endpoint to create by,
+	//seq counts the resources the key has created
+	Pick(eps []EndpointStat, seq uint64) int
+}
+
+//Create by each endpoint in turn, the default
+type BalanceRoundRobin struct{}
+
+//Create by the endpoint with the fewest resources in use,
+//the endpoints are tried in turn on tie
+type BalanceLeastConn struct{}
+
+//Create by the one with fewer resources in use of two endpoints chosen at random
+type BalanceP2C struct{}
+
+func (BalanceRoundRobin) Pick(eps []EndpointStat, seq uint64) int {
+	return int(seq % uint64(len(eps)))
+}
+
+func (BalanceLeastConn) Pick(eps []EndpointStat, seq uint64) int {
+	n := len(eps)
+	best := int(seq % uint64(n))
+	for i := 1; i < n; i++ {
+		pos := (best + i) % n
+		if eps[pos].Busy < eps[best].Busy {
+			best = pos
+		}
+	}
+	return best
+}
+
+func (BalanceP2C) Pick(eps []EndpointStat, seq uint64) int {
+	n := len(eps)
+	if n == 1 {
+		return 0
+	}
+
+	a := rand.Intn(n)
+	b := rand.Intn(n - 1)
+	if b >= a {
+		b++
+	}
+
+	if eps[b].Busy < eps[a].Busy {
+		return b
+	}
+	return a
+}
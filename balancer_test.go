@@ -0,0 +1,90 @@
+package srv
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBalancers(t *testing.T) {
+	t.Log("TestBalancers: Start Testing")
+	eps := []EndpointStat{
+		{Name: "a", Busy: 3},
+		{Name: "b", Busy: 1},
+		{Name: "c", Busy: 1},
+		{Name: "d", Busy: 2},
+	}
+
+	for seq := uint64(0); seq < 8; seq++ {
+		if pos := (BalanceRoundRobin{}).Pick(eps, seq); pos != int(seq%4) {
+			t.Error("Round-robin should take the endpoints in turn, pick ", pos)
+		}
+	}
+
+	//The fewest in use, the tie taken in turn
+	if pos := (BalanceLeastConn{}).Pick(eps, 0); pos != 1 {
+		t.Error("Least-connections should pick b, pick ", pos)
+	}
+	if pos := (BalanceLeastConn{}).Pick(eps, 2); pos != 2 {
+		t.Error("Least-connections should pick c on tie, pick ", pos)
+	}
+
+	//Never the busiest one of the two chosen
+	for i := 0; i < 100; i++ {
+		if pos := (BalanceP2C{}).Pick(eps, uint64(i)); pos == 0 {
+			t.Error("Power-of-two-choices should not pick the busiest endpoint")
+		}
+	}
+	if pos := (BalanceP2C{}).Pick(eps[:1], 0); pos != 0 {
+		t.Error("Power-of-two-choices should pick the only endpoint, pick ", pos)
+	}
+
+	t.Log("TestBalancers: End Testing")
+}
+
+func TestPoolBalanceLeastConn(t *testing.T) {
+	t.Log("TestPoolBalanceLeastConn: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var madeX, madeY int32
+	p.AddEndpoints("a", []Endpoint[*testRes]{
+		{Name: "x", Factory: testFactory("x", &madeX)},
+		{Name: "y", Factory: testFactory("y", &madeY)},
+	})
+	if err := p.SetBalancer("b", BalanceLeastConn{}); err == nil || err.Error() != ERROR_NO_EXIST_SERVER {
+		t.Error("Set balancer of unknown key should fail")
+	}
+	p.SetBalancer("a", BalanceLeastConn{})
+
+	//x gets two in use, y gets one then gives it back
+	x1, _ := p.Get(context.Background(), "a")
+	y1, _ := p.Get(context.Background(), "a")
+	x2, _ := p.Get(context.Background(), "a")
+	if x1.key != "x" || y1.key != "y" || x2.key != "x" {
+		t.Fatal("Least-connections should take the tie in turn")
+	}
+	p.Discard(y1)
+
+	//y has none in use, every new one goes to y
+	var res []*testRes
+	for i := 0; i < 2; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		res = append(res, r)
+	}
+	if res[0].key != "y" || res[1].key != "y" {
+		t.Error("Least-connections should dial the endpoint with fewer in use")
+	}
+
+	//Returned ones count as idle, not in use
+	p.Put("a", x1)
+	p.Put("a", x2)
+	p.lock.Lock()
+	busyX, busyY := p.keys["a"].endpoints[0].busy, p.keys["a"].endpoints[1].busy
+	p.lock.Unlock()
+	if busyX != 0 || busyY != 2 {
+		t.Error("The in use count is wrong ", busyX, busyY)
+	}
+
+	t.Log("TestPoolBalanceLeastConn: End Testing")
+}
@@ -0,0 +1,138 @@
+package srv
+
+import (
+	"time"
+)
+
+const DefaultBreakerThreshold = 5
+const DefaultBreakerCoolDown = 5 //Second
+
+//State of the circuit breaker of a key
+type CircuitState int
+
+const (
+	//Dials go through
+	CircuitClosed CircuitState = iota
+	//Dials fail fast until the cool-down is over
+	CircuitOpen
+	//One probe dial goes through, the others fail fast
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//Circuit breaker settings of a key
+type BreakerConfig struct {
+	//consecutive dial failures opening the circuit, DefaultBreakerThreshold if 0
+	Threshold int
+	//how long the circuit stays open before a probe dial, DefaultBreakerCoolDown if 0
+	CoolDown time.Duration
+	//called on every state change, without any lock held
+	OnStateChange func(from, to CircuitState)
+}
+
+//Check whether both configs are the same, the hooks by whether they are set
+func (c *BreakerConfig) same(other *BreakerConfig) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+
+	return c.Threshold == other.Threshold && c.CoolDown == other.CoolDown &&
+		(c.OnStateChange == nil) == (other.OnStateChange == nil)
+}
+
+//A state change to report once the lock is released
+type stateChange struct {
+	hook     func(from, to CircuitState)
+	from, to CircuitState
+}
+
+func (c stateChange) fire() {
+	if c.hook != nil && c.from != c.to {
+		c.hook(c.from, c.to)
+	}
+}
+
+//Circuit breaker of a key, guarded by the Pool lock
+type breaker struct {
+	config   BreakerConfig
+	state    CircuitState
+	failures int
+	//when the circuit was opened
+	openedAt time.Time
+	//the probe dial of the half-open circuit is running
+	probing bool
+}
+
+func newBreaker(config BreakerConfig) *breaker {
+	if config.Threshold <= 0 {
+		config.Threshold = DefaultBreakerThreshold
+	}
+	if config.CoolDown <= 0 {
+		config.CoolDown = DefaultBreakerCoolDown * time.Second
+	}
+
+	return &breaker{config: config}
+}
+
+func (b *breaker) setState(to CircuitState) stateChange {
+	change := stateChange{hook: b.config.OnStateChange, from: b.state, to: to}
+	b.state = to
+	return change
+}
+
+//Check whether a dial may go through, the half-open circuit lets one probe through
+func (b *breaker) allow(now time.Time) (bool, stateChange) {
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < b.config.CoolDown {
+			return false, stateChange{}
+		}
+
+		b.probing = true
+		return true, b.setState(CircuitHalfOpen)
+	case CircuitHalfOpen:
+		if b.probing {
+			return false, stateChange{}
+		}
+
+		b.probing = true
+		return true, stateChange{}
+	}
+
+	return true, stateChange{}
+}
+
+//The dial succeeded
+func (b *breaker) success() stateChange {
+	b.failures = 0
+	b.probing = false
+	return b.setState(CircuitClosed)
+}
+
+//The dial failed
+func (b *breaker) failure(now time.Time) stateChange {
+	b.failures++
+	b.probing = false
+	if b.state == CircuitClosed && b.failures < b.config.Threshold {
+		return stateChange{}
+	}
+
+	b.openedAt = now
+	return b.setState(CircuitOpen)
+}
+
+//The dial ended by its context, which tells nothing of the endpoint
+func (b *breaker) release() {
+	b.probing = false
+}
@@ -0,0 +1,100 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolCircuitBreaker(t *testing.T) {
+	t.Log("TestPoolCircuitBreaker: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var down int32 = 1
+	var dials int32
+	p.Add("a", func(ctx context.Context) (*testRes, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("refused")
+		}
+		return &testRes{key: "a"}, nil
+	})
+
+	var lock sync.Mutex
+	var changes []CircuitState
+	p.SetBreaker("a", &BreakerConfig{
+		Threshold: 3,
+		CoolDown:  50 * time.Millisecond,
+		OnStateChange: func(from, to CircuitState) {
+			lock.Lock()
+			changes = append(changes, to)
+			lock.Unlock()
+		},
+	})
+
+	//Opened by the threshold, then fail fast without dialing
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(context.Background(), "a"); err == nil || err.Error() != "refused" {
+			t.Error("The dial error should be returned, got ", err)
+		}
+	}
+	if p.CircuitState("a") != CircuitOpen {
+		t.Error("The circuit should be open, state ", p.CircuitState("a"))
+	}
+	if _, err := p.Get(context.Background(), "a"); err == nil || err.Error() != ERROR_CIRCUIT_OPEN {
+		t.Error("The open circuit should fail fast, got ", err)
+	}
+	if atomic.LoadInt32(&dials) != 3 {
+		t.Error("The open circuit should not dial, dials ", dials)
+	}
+
+	//A failed probe opens it again
+	time.Sleep(60 * time.Millisecond)
+	p.Get(context.Background(), "a")
+	if p.CircuitState("a") != CircuitOpen || atomic.LoadInt32(&dials) != 4 {
+		t.Error("The failed probe should open the circuit again")
+	}
+
+	//A canceled probe keeps it half-open
+	time.Sleep(60 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.Get(ctx, "a")
+	if p.CircuitState("a") != CircuitHalfOpen {
+		t.Error("The canceled probe should keep the circuit half-open, state ", p.CircuitState("a"))
+	}
+
+	//The probe succeeded closes it
+	atomic.StoreInt32(&down, 0)
+	r, err := p.Get(context.Background(), "a")
+	if err != nil || p.CircuitState("a") != CircuitClosed {
+		t.Error("The succeeded probe should close the circuit ", err)
+	}
+	p.Put("a", r)
+
+	lock.Lock()
+	expect := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(changes) != len(expect) {
+		t.Error("State changes ", changes, " expect ", expect)
+	}
+	for i := range changes {
+		if i < len(expect) && changes[i] != expect[i] {
+			t.Error("State changes ", changes, " expect ", expect)
+			break
+		}
+	}
+	lock.Unlock()
+
+	//Disabled
+	p.SetBreaker("a", nil)
+	if p.CircuitState("a") != CircuitClosed {
+		t.Error("The key without breaker should be closed")
+	}
+
+	t.Log("TestPoolCircuitBreaker: End Testing")
+}
@@ -0,0 +1,142 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+//Dial coalescing: with MaxDials set, a key runs at most that many dials at once,
+//the other misses wait for a resource put back or for a dial slot to free up
+
+//What a waiting Get is handed, a resource, an error or else a dial slot
+type dialTurn[K comparable, R io.Closer] struct {
+	pe  *PoolElement[K, R]
+	err error
+}
+
+//Get waiting on a key, guarded by the Pool lock
+type dialWaiter[K comparable, R io.Closer] struct {
+	turn chan dialTurn[K, R]
+	elem Element[*dialWaiter[K, R]]
+}
+
+//Check whether the waiter is still in the queue
+func (w *dialWaiter[K, R]) queued() bool {
+	return w.elem.next != nil
+}
+
+//Set how many dials the key runs at once, 0 for no limit
+func (p *Pool[K, R]) SetMaxDials(key K, n int) error {
+	if n < 0 {
+		n = 0
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return errors.New(ERROR_NO_EXIST_SERVER)
+	}
+
+	kp.maxDials = n
+	//a raised limit frees slots at once
+	for kp.dialSlotFree() && kp.waiters.Len() > 0 {
+		kp.dialing++
+		kp.popWaiter().turn <- dialTurn[K, R]{}
+	}
+	return nil
+}
+
+//Check whether a new dial of the key can start
+func (kp *KeyPool[K, R]) dialSlotFree() bool {
+	return kp.maxDials == 0 || kp.dialing < kp.maxDials
+}
+
+//Queue a Get for the next resource or dial slot of the key
+func (kp *KeyPool[K, R]) pushWaiter() *dialWaiter[K, R] {
+	w := &dialWaiter[K, R]{turn: make(chan dialTurn[K, R], 1)}
+	w.elem.Value = w
+	kp.waiters.PushBackElement(&w.elem)
+	return w
+}
+
+//Take the longest waiting Get, nil if none
+func (kp *KeyPool[K, R]) popWaiter() *dialWaiter[K, R] {
+	if kp.waiters.Len() == 0 {
+		return nil
+	}
+	return kp.waiters.Remove(kp.waiters.Front())
+}
+
+//Hand the resource put back to a waiting Get, false if none waits.
+//The caller must hold the lock
+func (p *Pool[K, R]) handOff(kp *KeyPool[K, R], pe *PoolElement[K, R]) bool {
+	w := kp.popWaiter()
+	if w == nil {
+		return false
+	}
+
+	p.checkOut(pe)
+	w.turn <- dialTurn[K, R]{pe: pe}
+	return true
+}
+
+//A dial of the key is over, its slot goes to the longest waiting Get.
+//The caller must hold the lock
+func (p *Pool[K, R]) releaseDial(kp *KeyPool[K, R]) {
+	kp.dialing--
+	if !kp.dialSlotFree() {
+		return
+	}
+
+	if w := kp.popWaiter(); w != nil {
+		kp.dialing++
+		w.turn <- dialTurn[K, R]{}
+	}
+}
+
+//Fail every Get waiting on the key with the error,
+//the caller must hold the lock
+func (p *Pool[K, R]) failWaiters(kp *KeyPool[K, R], err error) {
+	for w := kp.popWaiter(); w != nil; w = kp.popWaiter() {
+		w.turn <- dialTurn[K, R]{err: err}
+	}
+}
+
+//Wait as the queued waiter for a resource put back or a dial slot, the caller
+//must hold the lock and still holds it on return. dial tells a slot was handed over
+func (p *Pool[K, R]) waitTurn(ctx context.Context, kp *KeyPool[K, R], w *dialWaiter[K, R]) (r R, dial bool, err error) {
+	p.lock.Unlock()
+
+	var turn dialTurn[K, R]
+	select {
+	case turn = <-w.turn:
+		p.lock.Lock()
+	case <-ctx.Done():
+		p.lock.Lock()
+		if w.queued() {
+			kp.waiters.Remove(&w.elem)
+			return r, false, ctx.Err()
+		}
+
+		//handed a turn meanwhile, give it back
+		turn = <-w.turn
+		if turn.pe != nil {
+			p.lock.Unlock()
+			p.Put(kp.key, turn.pe.Res)
+			p.lock.Lock()
+		} else if turn.err == nil {
+			p.releaseDial(kp)
+		}
+		return r, false, ctx.Err()
+	}
+
+	if turn.err != nil {
+		return r, false, turn.err
+	}
+	if turn.pe != nil {
+		return turn.pe.Res, false, nil
+	}
+	return r, true, nil
+}
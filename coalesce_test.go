@@ -0,0 +1,111 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolMaxDials(t *testing.T) {
+	t.Log("TestPoolMaxDials: Start Testing")
+	p := NewPool[string, *testRes](100)
+	p.Start()
+	defer p.ShutDown()
+
+	var dialing, maxDialing, made int32
+	p.Add("a", func(ctx context.Context) (*testRes, error) {
+		n := atomic.AddInt32(&dialing, 1)
+		for {
+			m := atomic.LoadInt32(&maxDialing)
+			if n <= m || atomic.CompareAndSwapInt32(&maxDialing, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&dialing, -1)
+		atomic.AddInt32(&made, 1)
+		return &testRes{key: "a"}, nil
+	})
+	p.SetMaxDials("a", 2)
+
+	//Every Get gives its resource back, the waiters share them
+	var wg sync.WaitGroup
+	var fails int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := p.Get(context.Background(), "a")
+			if err != nil {
+				atomic.AddInt32(&fails, 1)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			p.Put("a", r)
+		}()
+	}
+	wg.Wait()
+
+	if fails != 0 {
+		t.Error("Get should not fail, fails ", fails)
+	}
+	if maxDialing > 2 {
+		t.Error("At most two dials should run at once, max ", maxDialing)
+	}
+	if made >= 50 {
+		t.Error("The waiters should take the resources put back, made ", made)
+	}
+	checkPoolLists(t, p)
+
+	//Time out while waiting
+	held := make([]*testRes, 0, 2)
+	p.SetMaxDials("a", 1)
+	for p.IdleLen("a") > 0 {
+		r, _ := p.Get(context.Background(), "a")
+		held = append(held, r)
+	}
+	slow := make(chan struct{})
+	go func() {
+		p.Get(context.Background(), "a")
+		close(slow)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("The waiting Get should end with its context, got ", err)
+	}
+	<-slow
+	p.lock.Lock()
+	waiters, dialingCnt := p.keys["a"].waiters.Len(), p.keys["a"].dialing
+	p.lock.Unlock()
+	if waiters != 0 || dialingCnt != 0 {
+		t.Error("The timed out waiter should leave the queue ", waiters, dialingCnt)
+	}
+
+	//Del fails the waiters
+	block := make(chan struct{})
+	p.Add("b", func(ctx context.Context) (*testRes, error) {
+		<-block
+		return &testRes{key: "b"}, nil
+	})
+	p.SetMaxDials("b", 1)
+	go p.Get(context.Background(), "b")
+	time.Sleep(5 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := p.Get(context.Background(), "b")
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	p.Del("b")
+	if err := <-done; err == nil || err.Error() != ERROR_NO_EXIST_SERVER {
+		t.Error("Del should fail the waiters, got ", err)
+	}
+	close(block)
+
+	t.Log("TestPoolMaxDials: End Testing")
+}
@@ -1,9 +1,14 @@
 package srv
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
+	"reflect"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -12,7 +17,8 @@ import (
 const DefaultMaxConnections = 20000
 const DefaultMaxServers = 10000
 const DefaultConnectionThresholdRate = 0.9
-const DefaultShrinkSpan = 100 //Millisecond
+const DefaultShrinkSpan = 100    //Millisecond
+const DefaultClosedCheckSpan = 1 //Second
 
 const (
 	ERROR_ADD_MORE_SERVER      = "MoreServer"
@@ -22,565 +28,771 @@ const (
 	ERROR_WRONG_SERVER_ID      = "WrongServerId"
 	ERROR_UNKNOWN              = "UnkownError"
 	ERROR_CONNPOOL_UNAVALIABLE = "UnAvaliable"
+	ERROR_NOT_TLS_SERVER       = "NotTlsServer"
+	ERROR_TLS_CONFIG_EMPTY     = "EmptyTlsConfig"
+	ERROR_UNSUPPORTED_NETWORK  = "UnsupportedNetwork"
+	ERROR_NO_ENDPOINT          = "NoEndpoint"
+	ERROR_CIRCUIT_OPEN         = "CircuitOpen"
+	ERROR_UNEXPECTED_DATA      = "UnexpectedData"
+	ERROR_SERVER_UNHEALTHY     = "ServerUnhealthy"
+	ERROR_ON_CONNECT           = "OnConnectFailed"
 )
 
-//LRU Element
-type LruElement struct {
-	next, prev *LruElement
-	//The value stored in the element
-	Value interface{}
+//The networks a server can be added with
+var supportedNetworks = map[string]bool{
+	"tcp":        true,
+	"tcp4":       true,
+	"tcp6":       true,
+	"unix":       true,
+	"unixpacket": true,
 }
 
-//Double link list,should support split and insert from front
-type ConnLRUList struct {
-	root LruElement
-	len  int
+type ConnMap struct {
+	//guards the server table and the resolve settings
+	lock sync.Mutex
+	cm   [DefaultMaxServers]*ConnPool
+	//the idle connections of all servers
+	pool *Pool[uint16, net.Conn]
+	//look up the servers added by hostname
+	resolver    Resolver
+	resolveSpan time.Duration
+	//resolve deamon
+	resolveDeamonRunning bool
+	//channel for notified the deamon
+	resolveChan chan bool
 }
 
-//New a connect LRU list and init it
-func NewConnLRUList() *ConnLRUList {
-	return new(ConnLRUList).InitConnLRUList()
+//Connection of a server and its pool, the pool itself keeps them as PoolElement
+//
+//Deprecated: the pool no longer hands these out, use ConnMap.Info to find the
+//endpoint and ResourceInfo.Uses for how many times a connection was checked out
+type ConnPoolElement struct {
+	SrvPool *ConnPool
+	Conn    net.Conn
 }
 
-//Init a connect list
-func (cl *ConnLRUList) InitConnLRUList() *ConnLRUList {
-	cl.root.next = &cl.root
-	cl.root.prev = &cl.root
-	cl.len = 0
-	return cl
+//Single server of the connect map
+type ConnPool struct {
+	id      uint16
+	network string
+	//the endpoints of the server, the first is the one it was added with
+	addrs []*serverAddr
+	//some host is a name to resolve
+	resolve bool
+	//choose the endpoint new connections are dialed to, nil for round-robin
+	balancer Balancer
+	//circuit breaker of the dials, nil if disabled
+	breaker *BreakerConfig
+	//retry of the failed dials, nil if disabled
+	retry *RetryPolicy
+	//dials running at once, 0 for no limit
+	maxDials int
+	//checkouts a connection is retired after, 0 for no limit
+	maxUses int
+	//check the idle connections instead of peeking at them, nil for the peek
+	ping func(ctx context.Context, c net.Conn) error
+	//check the connections put back for unread data
+	unreadCheck bool
+	//run on every new connection, an error closes it
+	onConnect func(ctx context.Context, c net.Conn) error
+	//run on every checkout and return, an error closes the connection
+	onCheckout func(c net.Conn) error
+	onReturn   func(c net.Conn) error
+	//deadline set on every checkout, none if 0
+	deadline time.Duration
+	//socket options of the dialed connections, nil for the Go defaults
+	sockOpts *SocketOptions
+	//active health check, nil if disabled
+	healthCheck *HealthCheck
+	healthStop  chan struct{}
+	health      ServerHealth
+	//guards the settings can be changed at runtime
+	lock sync.Mutex
+	//dial tls connections when set
+	tlsConfig *tls.Config
+	//the endpoint addresses last resolved
+	resolved []string
 }
 
-//The length of the connect LRU list
-func (cl *ConnLRUList) Len() int {
-	return cl.len
-}
+//Optional setting of a server
+type ServerOption func(cp *ConnPool)
 
-//Update the length of the list
-func (cl *ConnLRUList) SetLen(len int) {
-	if len >= 0 {
-		cl.len = len
+//Add more endpoints of the server, the connections are spread over all of them
+func WithEndpoints(addrs ...string) ServerOption {
+	return func(cp *ConnPool) {
+		for _, addr := range addrs {
+			cp.addAddr(addr)
+		}
 	}
 }
 
-//The front element of the connect LRU list
-func (cl *ConnLRUList) Front() *LruElement {
-	if cl.len > 0 {
-		return cl.root.next
+//Choose the endpoint new connections are dialed to by the balancer
+func WithBalancer(balancer Balancer) ServerOption {
+	return func(cp *ConnPool) {
+		cp.balancer = balancer
 	}
+}
 
-	return nil
+//Fail fast with ERROR_CIRCUIT_OPEN once the dials keep failing,
+//a probe dial is let through after the cool-down
+func WithCircuitBreaker(config BreakerConfig) ServerOption {
+	return func(cp *ConnPool) {
+		cp.breaker = &config
+	}
 }
 
-func (cl *ConnLRUList) Back() *LruElement {
-	if cl.len > 0 {
-		return cl.root.prev
+//Retry the failed dials by the policy within the Get context
+func WithRetry(rp RetryPolicy) ServerOption {
+	return func(cp *ConnPool) {
+		cp.retry = &rp
 	}
+}
 
-	return nil
+//Run at most n dials to the server at once, the other misses wait
+//for a connection put back or a dial slot within the Get context
+func WithMaxDials(n int) ServerOption {
+	return func(cp *ConnPool) {
+		cp.maxDials = n
+	}
 }
 
-//Push sth to the list
-func (cl *ConnLRUList) PushFront(v interface{}) {
-	le := &LruElement{Value: v}
-	fn := cl.root.next
-	fn.prev = le
-	le.next = fn
-	le.prev = &cl.root
-	cl.root.next = le
-	cl.len++
+//Check the idle connections of the server by the ping instead of peeking
+//at the socket, an error closes the connection. See SetIdleCheck
+func WithPing(ping func(ctx context.Context, c net.Conn) error) ServerOption {
+	return func(cp *ConnPool) {
+		cp.ping = ping
+	}
 }
 
-//Pop the front element and return the value in the element
-func (cl *ConnLRUList) PopFront() interface{} {
-	if cl.len > 0 {
-		ve := cl.Front()
-		cl.root.next = ve.next
-		ve.next.prev = &cl.root
-		ve.next = nil
-		ve.prev = nil
+//Set the read and write deadline of every connection Get returns to the
+//time from the checkout, Put clears it
+func WithDeadline(d time.Duration) ServerOption {
+	return func(cp *ConnPool) {
+		cp.deadline = d
+	}
+}
 
-		cl.len--
-		return ve.Value
+//Check every connection put back without waiting, the ones with unread data
+//or closed by the peer are closed, counted as DiscardUnread. For a tls
+//connection only the close is detected
+func WithUnreadCheck() ServerOption {
+	return func(cp *ConnPool) {
+		cp.unreadCheck = true
 	}
+}
 
-	return nil
+//Run the hook on every new connection after the dial and the tls handshake,
+//such as a hello or auth exchange. An error closes the connection and
+//is returned by Get as a *ConnectError
+func WithOnConnect(hook func(ctx context.Context, c net.Conn) error) ServerOption {
+	return func(cp *ConnPool) {
+		cp.onConnect = hook
+	}
 }
 
-//Remove the specified element and return the value in it
-func (cl *ConnLRUList) Remove(pos *LruElement) interface{} {
-	if pos != nil && cl.len > 0 {
-		pos.prev.next = pos.next
-		pos.next.prev = pos.prev
+//Run the hook on every connection Get returns, an error closes
+//the connection and is returned by Get
+func WithOnCheckout(hook func(c net.Conn) error) ServerOption {
+	return func(cp *ConnPool) {
+		cp.onCheckout = hook
+	}
+}
 
-		pos.next = nil
-		pos.prev = nil
+//Run the hook on every connection put back before it is pooled, such as
+//a reset of the session state. An error closes the connection
+func WithOnReturn(hook func(c net.Conn) error) ServerOption {
+	return func(cp *ConnPool) {
+		cp.onReturn = hook
+	}
+}
 
-		cl.len--
-		return pos.Value
+//Close the connections on Put once checked out n times, counted as DiscardRetired
+func WithMaxUses(n int) ServerOption {
+	return func(cp *ConnPool) {
+		cp.maxUses = n
 	}
+}
 
-	return nil
+//Dial tls connections with the config, the handshake is done before Get returns.
+//The config is cloned, a nil config means plaintext
+func WithTLS(config *tls.Config) ServerOption {
+	return func(cp *ConnPool) {
+		if config != nil {
+			cp.tlsConfig = config.Clone()
+		}
+	}
 }
 
-//Just update LRU list information with cut the list by position at
-func (cl *ConnLRUList) PartitionListQuick(at *LruElement, len int, isSeq bool) *ConnLRUList {
-	if at == nil || len < 0 {
-		return nil
+func newConnPool(id uint16, network, addr string, opts ...ServerOption) *ConnPool {
+	cp := &ConnPool{
+		id:      id,
+		network: network,
+		health:  ServerHealth{Healthy: true},
 	}
+	cp.addAddr(addr)
 
-	pcl := NewConnLRUList()
-	pcl.root.next = at
-	pcl.root.prev = cl.root.prev
-	pcl.root.prev.next = &pcl.root
+	for _, opt := range opts {
+		opt(cp)
+	}
 
-	cl.root.prev = at.prev
-	at.prev.next = &cl.root
+	return cp
+}
 
-	at.prev = &pcl.root
+//Add an endpoint address, the duplicated and empty ones are dropped
+func (cp *ConnPool) addAddr(addr string) {
+	if addr == "" {
+		return
+	}
 
-	if isSeq {
-		pcl.len = cl.len - len
-		cl.len = len
-	} else {
-		pcl.len = len
-		cl.len = cl.len - len
+	for _, a := range cp.addrs {
+		if a.addr == addr {
+			return
+		}
 	}
 
-	return pcl
+	a := newServerAddr(cp.network, addr)
+	cp.resolve = cp.resolve || a.resolve
+	cp.addrs = append(cp.addrs, a)
 }
 
-//Partition the list in the specified position
-func (cl *ConnLRUList) PartitionList(pos int, isSeq bool) *ConnLRUList {
-	if pos < 0 || cl.len < pos {
-		return nil
+//Check whether the other is registered the same way, by the same options.
+//The hooks and the other functions are compared by whether they are set,
+//the balancer by its type and value and the tls config by sameTLS
+func (cp *ConnPool) sameServer(other *ConnPool) bool {
+	if cp.id != other.id || cp.network != other.network || len(cp.addrs) != len(other.addrs) {
+		return false
 	}
 
-	p := &cl.root
-	for i := 0; i < pos; i++ {
-		if isSeq {
-			p = p.next
-		} else {
-			p = p.prev
+	for i := range cp.addrs {
+		if cp.addrs[i].addr != other.addrs[i].addr {
+			return false
 		}
 	}
 
-	pcl := cl.PartitionListQuick(p, pos, isSeq)
+	if !sameTLS(cp.getTLSConfig(), other.getTLSConfig()) || !sameBalancer(cp.balancer, other.balancer) {
+		return false
+	}
 
-	return pcl
-}
+	set := [][2]bool{
+		{cp.ping != nil, other.ping != nil},
+		{cp.onConnect != nil, other.onConnect != nil},
+		{cp.onCheckout != nil, other.onCheckout != nil},
+		{cp.onReturn != nil, other.onReturn != nil},
+	}
+	for _, s := range set {
+		if s[0] != s[1] {
+			return false
+		}
+	}
 
-type ConnMap struct {
-	lock          sync.Mutex
-	cm            [DefaultMaxServers]*ConnPool
-	sharedConnLru *ConnLRUList
-	//capacity
-	capacity int
-	//is avaliable
-	isAvaliable bool
-	//check shrinking stat
-	isShrinking bool
-	//shrink deamon
-	shrinkDeamonRunning bool
-	//channel for notified the deamon
-	shrinkChan chan bool
+	return cp.maxDials == other.maxDials && cp.maxUses == other.maxUses &&
+		cp.deadline == other.deadline && cp.unreadCheck == other.unreadCheck &&
+		cp.breaker.same(other.breaker) && cp.retry.same(other.retry) &&
+		cp.sockOpts.same(other.sockOpts) && cp.healthCheck.same(other.healthCheck)
 }
 
-type ConnPoolElement struct {
-	SrvPool *ConnPool
-	Conn    net.Conn
+//Check whether both balancers pick the same way, by the dynamic type
+//and by the value when it is comparable
+func sameBalancer(a, b Balancer) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	return a == nil || !reflect.ValueOf(a).Comparable() || a == b
 }
 
-//Single server connect pool
-type ConnPool struct {
-	lock sync.Mutex
-	id   uint16
-	addr string
-	list *ConnLRUList
+//Check whether both tls configs dial the same way, by the fields the client
+//handshake depends on. The callbacks are compared by whether they are set
+func sameTLS(a, b *tls.Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if a.ServerName != b.ServerName || a.InsecureSkipVerify != b.InsecureSkipVerify ||
+		a.MinVersion != b.MinVersion || a.MaxVersion != b.MaxVersion || !a.RootCAs.Equal(b.RootCAs) ||
+		!sameSlice(a.NextProtos, b.NextProtos) || !sameSlice(a.CipherSuites, b.CipherSuites) ||
+		!sameSlice(a.CurvePreferences, b.CurvePreferences) || len(a.Certificates) != len(b.Certificates) {
+		return false
+	}
+
+	for i := range a.Certificates {
+		ca, cb := a.Certificates[i].Certificate, b.Certificates[i].Certificate
+		if len(ca) != len(cb) {
+			return false
+		}
+		for j := range ca {
+			if !bytes.Equal(ca[j], cb[j]) {
+				return false
+			}
+		}
+	}
+
+	return (a.GetClientCertificate == nil) == (b.GetClientCertificate == nil) &&
+		(a.VerifyPeerCertificate == nil) == (b.VerifyPeerCertificate == nil) &&
+		(a.VerifyConnection == nil) == (b.VerifyConnection == nil)
 }
 
-func newConnPool(id uint16, ip string) *ConnPool {
-	return &ConnPool{
-		id:   id,
-		addr: ip,
-		list: NewConnLRUList(),
+//Check whether both slices hold the same values in the same order
+func sameSlice[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
+	return true
 }
 
-//Get idle connection count
-func (cp *ConnPool) getIdleCnt() int {
-	return cp.list.Len()
+//The tls config new connections are dialed with
+func (cp *ConnPool) getTLSConfig() *tls.Config {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.tlsConfig
 }
 
-//Put connection to the idle list
-func (cp *ConnPool) put(v interface{}) {
-	cp.list.PushFront(v)
+//Replace the tls config of a tls server, the config is cloned
+func (cp *ConnPool) setTLSConfig(config *tls.Config) error {
+	if config == nil {
+		return errors.New(ERROR_TLS_CONFIG_EMPTY)
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if cp.tlsConfig == nil {
+		return errors.New(ERROR_NOT_TLS_SERVER)
+	}
+
+	cp.tlsConfig = config.Clone()
+	return nil
 }
 
-//Get one idle connection
-func (cp *ConnPool) get() interface{} {
-	if cp.list == nil || cp.list.Len() == 0 {
-		return nil
+//The endpoints the server is dialed by before any resolve
+func (cp *ConnPool) endpoints() []Endpoint[net.Conn] {
+	eps := make([]Endpoint[net.Conn], 0, len(cp.addrs))
+	for _, a := range cp.addrs {
+		eps = append(eps, Endpoint[net.Conn]{Name: a.addr, Factory: cp.dialer(a.addr, "")})
 	}
+	return eps
+}
+
+//Dial new connections to the address of the server, the tls server name
+//defaults to host so a resolved address is verified against its name
+func (cp *ConnPool) dialer(addr, host string) Factory[net.Conn] {
+	return func(ctx context.Context) (net.Conn, error) {
+		c, err := cp.sockOpts.dialer().DialContext(ctx, cp.network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = cp.sockOpts.apply(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		config := cp.getTLSConfig()
+		if config == nil {
+			return cp.connected(ctx, c)
+		}
 
-	return cp.list.PopFront()
+		if config.ServerName == "" {
+			if host == "" {
+				host, _, _ = net.SplitHostPort(addr)
+			}
+			config = config.Clone()
+			config.ServerName = host
+		}
+
+		tc := tls.Client(c, config)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return cp.connected(ctx, tc)
+	}
 }
 
-func NewConnMap(capx int) *ConnMap {
-	if capx > DefaultMaxConnections {
-		capx = DefaultMaxConnections
+//Run the OnConnect hook on the new connection, closing it on failure
+func (cp *ConnPool) connected(ctx context.Context, c net.Conn) (net.Conn, error) {
+	if cp.onConnect == nil {
+		return c, nil
 	}
 
-	return &ConnMap{
-		capacity:      capx,
-		isShrinking:   false,
-		isAvaliable:   false,
-		sharedConnLru: NewConnLRUList(),
+	if err := cp.onConnect(ctx, c); err != nil {
+		c.Close()
+		return nil, &ConnectError{Err: err}
 	}
+	return c, nil
 }
 
-func (p *ConnMap) Start() {
-	p.lock.Lock()
-	p.isAvaliable = true
+//Error of the OnConnect hook, returned by Get in place of the connection
+type ConnectError struct {
+	Err error
+}
 
-	if p.shrinkDeamonRunning == false {
-		p.shrinkChan = make(chan bool)
-		go p.shrinkDaemon()
-		p.shrinkDeamonRunning = true
+func (e *ConnectError) Error() string {
+	return ERROR_ON_CONNECT + ": " + e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+func NewConnMap(capx int) *ConnMap {
+	m := &ConnMap{
+		pool:        NewPool[uint16, net.Conn](capx),
+		resolver:    net.DefaultResolver,
+		resolveSpan: DefaultResolveSpan * time.Second,
 	}
+	//A connection closed by the caller instead of put back is released
+	m.pool.SetClosedCheck(connClosed)
+	return m
+}
+
+func (p *ConnMap) Start() {
+	p.pool.Start()
 
+	p.lock.Lock()
+	if p.resolveDeamonRunning == false {
+		p.resolveChan = make(chan bool, 1)
+		go p.resolveDaemon(p.resolveChan)
+		p.resolveDeamonRunning = true
+	}
 	p.lock.Unlock()
 }
 
-//Get specified server connection pool
+//Get specified server connection pool,
+//the connection is given back by Put, Discard or its Close
 func (p *ConnMap) Get(id uint16) (c net.Conn, err error) {
-	if !p.isAvaliable {
-		err = errors.New(ERROR_CONNPOOL_UNAVALIABLE)
-		return
-	}
+	return p.GetContext(context.Background(), id)
+}
 
+//Get specified server connection, a new connection is dialed under ctx
+func (p *ConnMap) GetContext(ctx context.Context, id uint16) (c net.Conn, err error) {
 	if id >= DefaultMaxServers {
+		if !p.pool.IsAvaliable() {
+			err = errors.New(ERROR_CONNPOOL_UNAVALIABLE)
+			return
+		}
+
 		err = errors.New(ERROR_WRONG_SERVER_ID)
 		return
 	}
 
 	p.lock.Lock()
 	cp := p.cm[id]
-	if cp == nil {
-		p.lock.Unlock()
-		err = errors.New(ERROR_NO_EXIST_SERVER)
+	p.lock.Unlock()
+	if cp != nil && !cp.isHealthy() {
+		err = errors.New(ERROR_SERVER_UNHEALTHY)
 		return
 	}
 
-	cp.lock.Lock()
-	p.lock.Unlock()
-	index := cp.get()
-
-	p.lock.Lock()
-	cp.lock.Unlock()
-	if index == nil {
-		p.lock.Unlock()
-		//new one connection
-		c, err = net.Dial("tcp", cp.addr)
+	if c, err = p.pool.Get(ctx, id); err != nil {
 		return
 	}
 
-	ce := p.sharedConnLru.Remove(index.(*LruElement))
-	p.lock.Unlock()
-	if ce != nil {
-		c = ce.(*ConnPoolElement).Conn
-		return c, nil
+	//Start the borrow with the default deadline of the server
+	if cp != nil && cp.deadline > 0 {
+		if err = c.SetDeadline(time.Now().Add(cp.deadline)); err != nil {
+			p.pool.discard(c, DiscardDead)
+			return nil, err
+		}
 	}
 
-	err = errors.New(ERROR_UNKNOWN)
-	return
+	if cp != nil && cp.onCheckout != nil {
+		if err = cp.onCheckout(c); err != nil {
+			p.pool.discard(c, DiscardHook)
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
-//Put connection to the specified server pool
+//Put connection to the specified server pool, its deadlines are cleared
+//and the OnReturn hook of the server is run
 func (p *ConnMap) Put(id uint16, c net.Conn) {
 	if c == nil {
 		return
 	}
 
-	if !p.isAvaliable || id >= DefaultMaxServers {
+	if id >= DefaultMaxServers {
 		c.Close()
 		return
 	}
 
+	//The next borrower starts without the deadlines of this one
+	c.SetDeadline(time.Time{})
+
 	p.lock.Lock()
 	cp := p.cm[id]
-	if cp == nil {
-		p.lock.Unlock()
-		c.Close()
+	p.lock.Unlock()
+	//An ejected server keeps no idle connections
+	if cp != nil && !cp.isHealthy() {
+		p.pool.discard(c, DiscardStale)
 		return
 	}
-	p.lock.Unlock()
 
-	cpe := &ConnPoolElement{
-		SrvPool: cp,
-		Conn:    c,
+	//Unread data would reach the next borrower
+	if cp != nil && cp.unreadCheck && probeConn(c) != nil {
+		p.pool.discard(c, DiscardUnread)
+		return
 	}
-	p.lock.Lock()
-	p.sharedConnLru.PushFront(cpe)
-	clf := p.sharedConnLru.Front()
-	cp.lock.Lock()
-	p.lock.Unlock()
-	cp.list.PushFront(clf)
-	cp.lock.Unlock()
-
-	//Whether need to shrink
-	if p.sharedConnLru.Len() > int(float64(p.capacity)*DefaultConnectionThresholdRate) {
-		go func() {
-			//check channel if closed
-			select {
-			case _, isok := <-p.shrinkChan:
-				if !isok {
-					//Channel closed
-					return
-				}
-
-			//channel is empty
-			default:
-			}
 
-			select {
-			//Send shrink signal
-			case p.shrinkChan <- true:
-			//channel is full
-			default:
-			}
-		}()
+	if cp != nil && cp.onReturn != nil {
+		if err := cp.onReturn(c); err != nil {
+			p.pool.discard(c, DiscardHook)
+			return
+		}
+	}
+
+	p.pool.Put(id, c)
+}
+
+//Close the connection taken by Get instead of putting it back
+func (p *ConnMap) Discard(c net.Conn) {
+	if c == nil {
+		return
 	}
+
+	p.pool.Discard(c)
+}
+
+//Set which idle connection of a server Get takes
+func (p *ConnMap) SetReusePolicy(reuse ReusePolicy) {
+	p.pool.SetReusePolicy(reuse)
 }
 
-//Add specified server , create connection pool
-func (p *ConnMap) AddServer(id uint16, ipPort string) (err error) {
-	if !p.isAvaliable {
+//Set which idle connections the shrink closes, nil for EvictLRU
+func (p *ConnMap) SetEvictionPolicy(evict EvictionPolicy) {
+	p.pool.SetEvictionPolicy(evict)
+}
+
+//Add specified server , create connection pool.
+//A replica set is added with WithEndpoints and balanced by WithBalancer
+func (p *ConnMap) AddServer(id uint16, ipPort string, opts ...ServerOption) (err error) {
+	return p.AddServerNetwork(id, "tcp", ipPort, opts...)
+}
+
+//Add specified server reached by the network and address as net.Dial takes them,
+//the network is one of tcp, tcp4, tcp6, unix and unixpacket. Adding a registered
+//server again is a no-op with the same options, else ERROR_CONFLICT_SERVER_INFO
+func (p *ConnMap) AddServerNetwork(id uint16, network, address string, opts ...ServerOption) (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.pool.IsAvaliable() {
 		return errors.New(ERROR_CONNPOOL_UNAVALIABLE)
 	}
 
-	if len(ipPort) == 0 {
+	if len(address) == 0 {
 		return errors.New(ERROR_IP_PORT_EMPTY)
 	}
 
+	if !supportedNetworks[network] {
+		return errors.New(ERROR_UNSUPPORTED_NETWORK)
+	}
+
 	if id >= DefaultMaxServers {
 		return errors.New(ERROR_WRONG_SERVER_ID)
 	}
 
-	p.lock.Lock()
-	cp := p.cm[id]
+	cp := newConnPool(id, network, address, opts...)
 	// already exist
-	if cp != nil {
-		p.lock.Unlock()
-		if id == cp.id && cp.addr == ipPort {
+	if old := p.cm[id]; old != nil {
+		if old.sameServer(cp) {
 			return
 		}
 
 		return errors.New(ERROR_CONFLICT_SERVER_INFO)
 	}
 
-	cp = newConnPool(id, ipPort)
+	if err = p.pool.AddEndpoints(id, cp.endpoints()); err != nil {
+		return
+	}
+
+	if cp.balancer != nil {
+		p.pool.SetBalancer(id, cp.balancer)
+	}
+	if cp.breaker != nil {
+		p.pool.SetBreaker(id, cp.breaker)
+	}
+	if cp.retry != nil {
+		p.pool.SetRetryPolicy(id, cp.retry)
+	}
+	if cp.maxDials > 0 {
+		p.pool.SetMaxDials(id, cp.maxDials)
+	}
+	if cp.maxUses > 0 {
+		p.pool.SetMaxUses(id, cp.maxUses)
+	}
+
 	p.cm[id] = cp
-	p.lock.Unlock()
+	p.startHealthCheck(cp)
+	if cp.resolve {
+		p.notifyResolveLocked()
+	}
 	return
 }
 
-//Del specified server
-func (p *ConnMap) DelServer(id uint16) {
-	if !p.isAvaliable {
-		return
-	}
-
+//Replace the tls config of the server. The idle connections established with the
+//old config are closed on next checkout or shrink tick, the ones in use when put back
+func (p *ConnMap) SetServerTLSConfig(id uint16, config *tls.Config) error {
 	if id >= DefaultMaxServers {
-		return
+		return errors.New(ERROR_WRONG_SERVER_ID)
 	}
 
 	p.lock.Lock()
+	defer p.lock.Unlock()
 	cp := p.cm[id]
 	if cp == nil {
-		p.lock.Unlock()
-		return
+		return errors.New(ERROR_NO_EXIST_SERVER)
 	}
 
-	p.cm[id] = nil
-	p.lock.Unlock()
+	if err := cp.setTLSConfig(config); err != nil {
+		return err
+	}
 
-	go p.CloseConnPool(cp)
+	p.pool.Expire(id)
+	return nil
 }
 
-//Shrink the connect pool and return the last pos should be split
-func (p *ConnMap) findShrinkPos(needShrinkCnt int) (lastpos *LruElement, actualpos int) {
-	if p.sharedConnLru.Len() == 0 || needShrinkCnt > p.sharedConnLru.Len() {
-		return
+//Replace the tls config of every tls server, the same way as SetServerTLSConfig
+func (p *ConnMap) SetTLSConfig(config *tls.Config) error {
+	if config == nil {
+		return errors.New(ERROR_TLS_CONFIG_EMPTY)
 	}
 
 	p.lock.Lock()
-	//The Zero position
-	lastpos = p.sharedConnLru.Front().prev
-	actualpos = 0
-	for ; actualpos < needShrinkCnt && p.sharedConnLru.Len() > 0; actualpos++ {
-		lastpos = lastpos.prev
-		if lastpos == nil {
-			break
-		}
-
-		if lastpos.Value == nil {
+	defer p.lock.Unlock()
+	for _, cp := range p.cm {
+		if cp == nil || cp.getTLSConfig() == nil {
 			continue
 		}
 
-		//Remove the last of the connect pool list
-		kcp := lastpos.Value.(*ConnPoolElement).SrvPool
-		kcp.lock.Lock()
-		p.lock.Unlock()
-		back := kcp.list.Back()
-		if back != nil && back.Value == lastpos {
-			kcp.list.Remove(kcp.list.Back())
-		}
-		p.lock.Lock()
-		kcp.lock.Unlock()
+		cp.setTLSConfig(config)
+		p.pool.Expire(cp.id)
 	}
-	p.lock.Unlock()
 
-	return lastpos, actualpos
+	return nil
 }
 
-//Shrink daemon for shrink connnect pool
-func (p *ConnMap) shrinkDaemon() {
-	for {
-		select {
-		//Receive shrink signal
-		case _, ok := <-p.shrinkChan:
-			//Channel close
-			if !ok {
-				break
-			}
-		//Time out for shrink
-		case <-time.After(DefaultShrinkSpan * time.Millisecond):
-		}
-
-		p.shrink()
+//Check the connections idle for the span in the background, 0 to stop checking.
+//A connection closed by the peer or with unexpected data is closed,
+//the servers added WithPing are checked by their ping
+func (p *ConnMap) SetIdleCheck(span time.Duration) {
+	if span <= 0 {
+		p.pool.SetIdleProbe(nil, 0)
+		return
 	}
+
+	p.pool.SetIdleProbe(p.probeIdle, span)
 }
 
-//Close connection in the list
-func (p *ConnMap) closeAllConn(clearList *ConnLRUList) {
-	for clearList.Len() > 0 {
-		ce := clearList.PopFront()
-		if ce != nil {
-			c := ce.(*ConnPoolElement).Conn
-			c.Close()
-		}
+//Probe the idle connection of the server
+func (p *ConnMap) probeIdle(ctx context.Context, id uint16, c net.Conn) error {
+	p.lock.Lock()
+	cp := p.cm[id]
+	p.lock.Unlock()
+
+	if cp != nil && cp.ping != nil {
+		return cp.ping(ctx, c)
 	}
+	return probeConn(c)
 }
 
-//Shrink the global connection pool
-func (p *ConnMap) shrink() {
-	if !p.isAvaliable || p.isShrinking {
-		return
+//Check whether the connection was closed, by the caller of Get without Put or Discard.
+//A connection without a socket is never found closed
+func connClosed(c net.Conn) bool {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
 	}
 
-	p.lock.Lock()
-	if p.isShrinking {
-		p.lock.Unlock()
-		return
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
 	}
 
-	//Shrink to threshold
-	needShrinkCnt :=
-		p.sharedConnLru.Len() - int(float64(p.capacity)*DefaultConnectionThresholdRate)
+	//fails once the socket is closed, the socket itself is left as is
+	return rc.Control(func(fd uintptr) {}) != nil
+}
 
-	if needShrinkCnt <= 0 {
-		p.isShrinking = false
-		p.lock.Unlock()
-		return
-	}
+//How many connections of the server were closed instead of pooled for the reason
+func (p *ConnMap) DiscardCount(id uint16, reason DiscardReason) uint64 {
+	return p.pool.DiscardCount(id, reason)
+}
 
-	p.isShrinking = true
-	p.lock.Unlock()
+//What the idle check found of the server
+func (p *ConnMap) IdleHealth(id uint16) IdleHealth {
+	return p.pool.IdleHealth(id)
+}
 
-	//Reverse traversal the global LRU list
-	//and mark the position should be cut off in the conn pool
-	lastpos, actual := p.findShrinkPos(needShrinkCnt)
-	if lastpos == nil || actual == 0 {
-		//set isshrinking
-		p.lock.Lock()
-		p.isShrinking = false
-		p.lock.Unlock()
+//Circuit state of the server, closed if it has no breaker
+func (p *ConnMap) CircuitState(id uint16) CircuitState {
+	return p.pool.CircuitState(id)
+}
+
+//Del specified server
+func (p *ConnMap) DelServer(id uint16) {
+	if id >= DefaultMaxServers {
 		return
 	}
 
-	//Cut off the lru list
 	p.lock.Lock()
-	clearList := p.sharedConnLru.PartitionListQuick(lastpos, actual, false)
+	if p.cm[id] == nil {
+		p.lock.Unlock()
+		return
+	}
 
-	p.isShrinking = false
+	p.stopHealthCheck(p.cm[id])
+	p.cm[id] = nil
+	p.pool.Del(id)
 	p.lock.Unlock()
-
-	//Close all connection already shrink
-	if clearList != nil && clearList.Len() > 0 {
-		go p.closeAllConn(clearList)
-	}
 }
 
 //Close specified connection pool
 func (p *ConnMap) CloseConnPool(cp *ConnPool) {
-	if cp == nil || cp.list == nil {
+	if cp == nil {
 		return
 	}
 
-	cp.lock.Lock()
-	for cp.list.Len() > 0 {
-		index := cp.list.PopFront()
-		if index == nil {
-			continue
-		}
-
-		p.lock.Lock()
-		cp.lock.Unlock()
-		ce := p.sharedConnLru.Remove(index.(*LruElement))
-		p.lock.Unlock()
-		if ce != nil {
-			c := ce.(*ConnPoolElement).Conn
-			c.Close()
-		}
-
-		cp.lock.Lock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	//the server is deleted or replaced
+	if p.cm[cp.id] != cp {
+		return
 	}
 
-	cp.lock.Unlock()
+	p.pool.Drain(cp.id)
 }
 
 //Close whole connection pool
 func (p *ConnMap) Close() {
 	p.lock.Lock()
 
-	//unavaliable
-	p.isAvaliable = false
-
-	for i, _ := range p.cm {
-		//Clear the connect pool first
-		cp := p.cm[i]
-		if cp == nil {
-			continue
+	p.pool.Close()
+	for i, cp := range p.cm {
+		if cp != nil {
+			p.stopHealthCheck(cp)
 		}
 		p.cm[i] = nil
 	}
 
-	if p.sharedConnLru.Len() > 0 {
-		//clear all connnection
-		cleanLru := p.sharedConnLru.PartitionListQuick(p.sharedConnLru.Front(), 0, true)
-		go p.closeAllConn(cleanLru)
-	}
-
-	p.isShrinking = false
-
 	p.lock.Unlock()
 }
 
 //Close all connection and release source
 func (p *ConnMap) ShutDown() {
-	if p.isAvaliable {
-		p.Close()
-	}
+	p.Close()
+	p.pool.ShutDown()
 
-	close(p.shrinkChan)
+	p.lock.Lock()
+	if p.resolveDeamonRunning {
+		close(p.resolveChan)
+		p.resolveChan = nil
+		p.resolveDeamonRunning = false
+	}
+	p.lock.Unlock()
 }
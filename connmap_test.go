@@ -1,11 +1,22 @@
 package srv
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -21,6 +32,66 @@ var (
 	serverStart = false
 )
 
+//Check whether the server is registered
+func hasServer(m *ConnMap, id uint16) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.cm[id] != nil
+}
+
+//Listen on the address, the accepted connections are held until the test ends
+func newTestListener(t *testing.T, address string) net.Listener {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return l
+}
+
+//Idle connection count of the server
+func idleCnt(m *ConnMap, id uint16) int {
+	return m.pool.IdleLen(id)
+}
+
+//Idle connection count of the whole map
+func sharedCnt(m *ConnMap) int {
+	return m.pool.Len()
+}
+
+//Registered server count
+func serverCnt(m *ConnMap) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cnt := 0
+	for _, v := range m.cm {
+		if v != nil {
+			cnt++
+		}
+	}
+	return cnt
+}
+
 func TestListPushFront(t *testing.T) {
 	t.Log("TestListPushFront: Start Testing")
 	//New empty list
@@ -263,13 +334,13 @@ func TestConnPut(t *testing.T) {
 	t.Log("TestCase: connect c is nil")
 	id--
 	oldCnt := 0
-	if gConnM.cm[id] != nil {
-		oldCnt = gConnM.cm[id].list.Len()
+	if hasServer(gConnM, id) {
+		oldCnt = idleCnt(gConnM, id)
 	} else {
 		gConnM.AddServer(id, DEFAULT_CONNSRV_IP_ADDR)
 	}
 	gConnM.Put(id, nil)
-	if gConnM.cm[id].list.Len() != oldCnt {
+	if idleCnt(gConnM, id) != oldCnt {
 		t.Error("nil can not be put in the list")
 	}
 
@@ -277,7 +348,7 @@ func TestConnPut(t *testing.T) {
 	t.Log("TestCase: Server id is not exist")
 	gConnM.DelServer(id)
 	gConnM.Put(id, c)
-	if gConnM.cm[id] != nil {
+	if hasServer(gConnM, id) {
 		t.Error("Server not add to the list")
 	}
 
@@ -286,24 +357,24 @@ func TestConnPut(t *testing.T) {
 	gConnM.DelServer(id)
 	gConnM.AddServer(id, DEFAULT_CONNSRV_IP_ADDR)
 	gConnM.Put(id, c)
-	if gConnM.cm[id].list.Len() != 1 {
+	if idleCnt(gConnM, id) != 1 {
 		t.Error("Put error happend")
 	}
 
 	//server connect pool have connection
 	t.Log("TestCase: server connect pool have connection")
 	normalPutCnt := 10
-	oldCnt = gConnM.cm[id].list.Len()
+	oldCnt = idleCnt(gConnM, id)
 	for i := 0; i < normalPutCnt; i++ {
 		gConnM.Put(id, c)
 	}
-	if gConnM.cm[id].list.Len() != (oldCnt + normalPutCnt) {
+	if idleCnt(gConnM, id) != (oldCnt + normalPutCnt) {
 		t.Error("Normal put error happend")
 	}
 
 	//put more connection
 	t.Log("TestCase: server connect pool have more connection")
-	oldCnt = gConnM.cm[id].list.Len()
+	oldCnt = idleCnt(gConnM, id)
 	moreCnt := 2000
 	for i := 0; i < moreCnt; i++ {
 		gConnM.Put(id, c)
@@ -311,12 +382,12 @@ func TestConnPut(t *testing.T) {
 
 	time.Sleep(5 * time.Second)
 
-	if gConnM.sharedConnLru.Len() > DEFAULT_CONNMAP_CAP {
-		t.Error("The pool count should smaller than the capcity,current count is ", gConnM.sharedConnLru.Len())
+	if sharedCnt(gConnM) > DEFAULT_CONNMAP_CAP {
+		t.Error("The pool count should smaller than the capcity,current count is ", sharedCnt(gConnM))
 	}
 
-	if gConnM.cm[id].list.Len() > DEFAULT_CONNMAP_CAP {
-		t.Error("The sub pool count should smaller than the capcity,current count is ", gConnM.cm[id].list.Len())
+	if idleCnt(gConnM, id) > DEFAULT_CONNMAP_CAP {
+		t.Error("The sub pool count should smaller than the capcity,current count is ", idleCnt(gConnM, id))
 	}
 
 	gConnM.DelServer(id)
@@ -390,19 +461,21 @@ func TestDelServer(t *testing.T) {
 
 func TestAddAndDelServer(t *testing.T) {
 	maxlen := 2 * len(gConnM.cm)
-	stop := false
+	var stop int32
 
 	gConnM.Start()
 	//Del Server
 	go func() {
 		rand.Seed(time.Now().UnixNano())
 		for {
-			if stop {
+			if atomic.LoadInt32(&stop) == 1 {
 				break
 			}
 
 			index := rand.Intn(maxlen)
 			gConnM.DelServer(uint16(index))
+			//let the other side take the lock
+			runtime.Gosched()
 		}
 
 	}()
@@ -411,28 +484,25 @@ func TestAddAndDelServer(t *testing.T) {
 	go func() {
 		rand.Seed(time.Now().UnixNano())
 		for {
-			if stop {
+			if atomic.LoadInt32(&stop) == 1 {
 				break
 			}
 
 			index := rand.Intn(maxlen)
 			gConnM.AddServer(uint16(index), DEFAULT_CONNSRV_IP_ADDR)
+			//let the other side take the lock
+			runtime.Gosched()
 		}
 	}()
 
 	select {
 	case <-time.After(3 * time.Second):
-		stop = true
+		atomic.StoreInt32(&stop, 1)
 	}
 
 	time.Sleep(time.Second)
 
-	cnt := 0
-	for _, v := range gConnM.cm {
-		if v != nil {
-			cnt++
-		}
-	}
+	cnt := serverCnt(gConnM)
 
 	t.Log("The server left is ", cnt)
 	if cnt == len(gConnM.cm) || cnt == 0 {
@@ -461,11 +531,8 @@ func TestClose(t *testing.T) {
 	gConnM.Close()
 
 	t.Log("TestClose check gConnM")
-	for _, v := range gConnM.cm {
-		if v != nil {
-			t.Error("Close ConnMap failed")
-			break
-		}
+	if serverCnt(gConnM) != 0 {
+		t.Error("Close ConnMap failed")
 	}
 
 	id := uint16(1)
@@ -478,3 +545,931 @@ func TestClose(t *testing.T) {
 	}
 	t.Log("TestClose Test finished")
 }
+
+//Run with -race: hammer the public API from many goroutines
+func TestConcurrentAccess(t *testing.T) {
+	t.Log("TestConcurrentAccess: Start Testing")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 64)
+				for {
+					if _, err := c.Read(buf); err != nil {
+						c.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	addr := l.Addr().String()
+	cm := NewConnMap(16)
+	cm.Start()
+	const servers = 8
+	for i := uint16(0); i < servers; i++ {
+		cm.AddServer(i, addr)
+	}
+
+	var stop int32
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				id := uint16(rand.Intn(servers))
+				c, err := cm.Get(id)
+				if err != nil {
+					continue
+				}
+				cm.Put(id, c)
+			}
+		}(g)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&stop) == 0 {
+			id := uint16(rand.Intn(servers))
+			cm.DelServer(id)
+			cm.AddServer(id, addr)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&stop) == 0 {
+			time.Sleep(50 * time.Millisecond)
+			cm.Close()
+			cm.Start()
+			for i := uint16(0); i < servers; i++ {
+				cm.AddServer(i, addr)
+			}
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if sharedCnt(cm) > 16 {
+		t.Error("The pool count should smaller than the capcity,current count is ", sharedCnt(cm))
+	}
+
+	cm.ShutDown()
+	if _, err := cm.Get(0); err == nil || err.Error() != ERROR_CONNPOOL_UNAVALIABLE {
+		t.Error("Get should be unavaliable after shut down")
+	}
+	t.Log("TestConcurrentAccess: End Testing")
+}
+
+func TestConnGetPutAllocs(t *testing.T) {
+	t.Log("TestConnGetPutAllocs: Start Testing")
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(1, DEFAULT_CONNSRV_IP_ADDR)
+
+	c, peer := net.Pipe()
+	defer peer.Close()
+	cm.Put(1, c)
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		c, err := cm.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm.Put(1, c)
+	})
+	if allocs != 0 {
+		t.Error("Steady state Get/Put should not allocate, allocs ", allocs)
+	}
+
+	t.Log("TestConnGetPutAllocs: End Testing")
+}
+
+func TestConnCloseWithoutPut(t *testing.T) {
+	t.Log("TestConnCloseWithoutPut: Start Testing")
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(1, DEFAULT_CONNSRV_IP_ADDR)
+
+	//Closed by the caller, such as after an I/O error
+	for i := 0; i < 50; i++ {
+		c, err := cm.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	held, err := cm.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm.pool.releaseClosed()
+	cm.pool.lock.Lock()
+	busy := len(cm.pool.busy)
+	cm.pool.lock.Unlock()
+	if busy != 1 {
+		t.Error("The closed connections should be released, busy ", busy)
+	}
+	if s, err := cm.Server(1); err != nil || s.InUse != 1 || s.Discards[DiscardCaller] != 50 {
+		t.Error("Only the held connection should be in use ", s, err)
+	}
+
+	cm.Put(1, held)
+	if s, _ := cm.Server(1); s.InUse != 0 || s.Idle != 1 {
+		t.Error("Nothing should be left in use ", s)
+	}
+
+	t.Log("TestConnCloseWithoutPut: End Testing")
+}
+
+func TestConnGetTLS(t *testing.T) {
+	t.Log("TestConnGetTLS: Start Testing")
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	config := &tls.Config{RootCAs: roots}
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	addr := ts.Listener.Addr().String()
+	if err := cm.AddServer(1, addr, WithTLS(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	//Same server again, and the same address without tls
+	if err := cm.AddServer(1, addr, WithTLS(config)); err != nil {
+		t.Error("Add same server failed")
+	}
+	if err := cm.AddServer(1, addr); err == nil || err.Error() != ERROR_CONFLICT_SERVER_INFO {
+		t.Error("Plaintext server should conflict with the tls one")
+	}
+
+	c, err := cm.Get(1)
+	if err != nil {
+		t.Fatal("Should get a tls connection :", err)
+	}
+	tc, ok := c.(*tls.Conn)
+	if !ok || !tc.ConnectionState().HandshakeComplete {
+		t.Fatal("The connection should finish the handshake")
+	}
+
+	//The authenticated connection is pooled
+	cm.Put(1, c)
+	if c2, err := cm.Get(1); err != nil || c2 != c {
+		t.Error("Should reuse the tls connection")
+	}
+
+	//Server not trusted
+	cm.AddServer(2, addr, WithTLS(&tls.Config{}))
+	if _, err := cm.Get(2); err == nil {
+		t.Error("Handshake with an untrusted server should fail")
+	}
+
+	//Handshake runs under the Get context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cm.GetContext(ctx, 1); err == nil {
+		t.Error("Get with canceled context should fail")
+	}
+
+	t.Log("TestConnGetTLS: End Testing")
+}
+
+func TestConnTLSReload(t *testing.T) {
+	t.Log("TestConnTLSReload: Start Testing")
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	//count the handshakes done with each config
+	var oldCnt, newCnt int32
+	newConfig := func(cnt *int32) *tls.Config {
+		return &tls.Config{
+			RootCAs: roots,
+			VerifyConnection: func(tls.ConnectionState) error {
+				atomic.AddInt32(cnt, 1)
+				return nil
+			},
+		}
+	}
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	addr := ts.Listener.Addr().String()
+	cm.AddServer(1, addr, WithTLS(newConfig(&oldCnt)))
+	cm.AddServer(2, addr)
+
+	idle, err := cm.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse, err := cm.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Put(1, idle)
+
+	if err := cm.SetServerTLSConfig(2, newConfig(&newCnt)); err == nil || err.Error() != ERROR_NOT_TLS_SERVER {
+		t.Error("Plaintext server has no tls config to replace")
+	}
+	if err := cm.SetServerTLSConfig(3, newConfig(&newCnt)); err == nil || err.Error() != ERROR_NO_EXIST_SERVER {
+		t.Error("The server should add first")
+	}
+	if err := cm.SetServerTLSConfig(1, nil); err == nil || err.Error() != ERROR_TLS_CONFIG_EMPTY {
+		t.Error("Nil tls config should be refused")
+	}
+	if err := cm.SetServerTLSConfig(1, newConfig(&newCnt)); err != nil {
+		t.Fatal(err)
+	}
+
+	//The in use connection keeps working
+	if _, err := inUse.Write([]byte("x")); err != nil {
+		t.Error("The connection in use should not be dropped :", err)
+	}
+
+	//The idle one is retired, the new one uses the new config
+	c, err := cm.Get(1)
+	if err != nil || c == idle {
+		t.Fatal("Should dial with the new config", err)
+	}
+	if atomic.LoadInt32(&oldCnt) != 2 || atomic.LoadInt32(&newCnt) != 1 {
+		t.Error("Handshake count old ", oldCnt, " new ", newCnt)
+	}
+	cm.Put(1, c)
+
+	//The old connection is not pooled when put back
+	cm.Put(1, inUse)
+	if idleCnt(cm, 1) != 1 {
+		t.Error("Only the new connection should be pooled, idle ", idleCnt(cm, 1))
+	}
+
+	//Swap the whole map
+	if err := cm.SetTLSConfig(newConfig(&oldCnt)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * DefaultShrinkSpan * time.Millisecond)
+	if idleCnt(cm, 1) != 0 {
+		t.Error("The shrink tick should retire the idle connection")
+	}
+
+	t.Log("TestConnTLSReload: End Testing")
+}
+
+func TestAddServerNetwork(t *testing.T) {
+	t.Log("TestAddServerNetwork: Start Testing")
+	path := filepath.Join(t.TempDir(), "srv.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix socket not supported: ", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.Write([]byte("hello"))
+			}()
+		}
+	}()
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	if err := cm.AddServerNetwork(1, "udp", "127.0.0.1:53"); err == nil || err.Error() != ERROR_UNSUPPORTED_NETWORK {
+		t.Error("udp should be unsupported")
+	}
+	if err := cm.AddServerNetwork(1, "unix", ""); err == nil || err.Error() != ERROR_IP_PORT_EMPTY {
+		t.Error("Empty address should be refused")
+	}
+
+	if err := cm.AddServerNetwork(1, "unix", path); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.AddServerNetwork(1, "unix", path); err != nil {
+		t.Error("Add same server failed")
+	}
+	if err := cm.AddServer(1, path); err == nil || err.Error() != ERROR_CONFLICT_SERVER_INFO {
+		t.Error("Same address on another network should conflict")
+	}
+
+	c, err := cm.Get(1)
+	if err != nil {
+		t.Fatal("Should dial the unix socket :", err)
+	}
+	if c.RemoteAddr().Network() != "unix" {
+		t.Error("Should be a unix connection")
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Error("Read from the unix connection error", err)
+	}
+
+	cm.Put(1, c)
+	if c2, err := cm.Get(1); err != nil || c2 != c {
+		t.Error("Should reuse the unix connection")
+	}
+
+	t.Log("TestAddServerNetwork: End Testing")
+}
+
+func TestAddServerEndpoints(t *testing.T) {
+	t.Log("TestAddServerEndpoints: Start Testing")
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		l := newTestListener(t, "127.0.0.1:0")
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	if err := cm.AddServer(1, addrs[0], WithEndpoints(addrs[1], addrs[2], addrs[0]), WithBalancer(BalanceLeastConn{})); err != nil {
+		t.Fatal(err)
+	}
+	if eps := cm.pool.Endpoints(1); len(eps) != 3 {
+		t.Error("The server should have three endpoints ", eps)
+	}
+	if err := cm.AddServer(1, addrs[0], WithEndpoints(addrs[1], addrs[2]), WithBalancer(BalanceLeastConn{})); err != nil {
+		t.Error("Add same replica set failed")
+	}
+	if err := cm.AddServer(1, addrs[0], WithEndpoints(addrs[1])); err == nil || err.Error() != ERROR_CONFLICT_SERVER_INFO {
+		t.Error("Another replica set should conflict")
+	}
+
+	//Connections are spread over the replicas
+	dialed := map[string]int{}
+	var conns []net.Conn
+	for i := 0; i < 6; i++ {
+		c, err := cm.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialed[c.RemoteAddr().String()]++
+		conns = append(conns, c)
+	}
+	for _, addr := range addrs {
+		if dialed[addr] != 2 {
+			t.Error("Connections should be spread over the replicas ", dialed)
+		}
+	}
+	for _, c := range conns {
+		cm.Put(1, c)
+	}
+	if idleCnt(cm, 1) != 6 {
+		t.Error("Put error happend, idle ", idleCnt(cm, 1))
+	}
+
+	t.Log("TestAddServerEndpoints: End Testing")
+}
+
+func TestAddServerOptions(t *testing.T) {
+	t.Log("TestAddServerOptions: Start Testing")
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	linger := 0
+	opts := []ServerOption{
+		WithMaxUses(10),
+		WithRetry(RetryPolicy{MaxAttempts: 3}),
+		WithSocketOptions(SocketOptions{Linger: &linger}),
+		WithHealthCheck(HealthCheck{Interval: time.Hour}),
+		WithOnReturn(func(c net.Conn) error { return nil }),
+		WithBalancer(BalanceLeastConn{}),
+		WithTLS(&tls.Config{ServerName: "a", NextProtos: []string{"h2"}}),
+	}
+	if err := cm.AddServer(1, DEFAULT_CONNSRV_IP_ADDR, opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	//The same options again, a fresh linger value and tls config included
+	other := 0
+	if err := cm.AddServer(1, DEFAULT_CONNSRV_IP_ADDR, WithMaxUses(10),
+		WithRetry(RetryPolicy{MaxAttempts: 3}),
+		WithSocketOptions(SocketOptions{Linger: &other}),
+		WithHealthCheck(HealthCheck{Interval: time.Hour}),
+		WithOnReturn(func(c net.Conn) error { return errors.New("other") }),
+		WithBalancer(BalanceLeastConn{}),
+		WithTLS(&tls.Config{ServerName: "a", NextProtos: []string{"h2"}})); err != nil {
+		t.Error("Add same server with the same options failed ", err)
+	}
+
+	//Any option missing, added or changed conflicts instead of being dropped
+	conflicts := [][]ServerOption{
+		nil,
+		append(opts[:len(opts):len(opts)], WithDeadline(time.Second)),
+		append(opts[:len(opts):len(opts)], WithOnConnect(func(ctx context.Context, c net.Conn) error { return nil })),
+		append(opts[:len(opts):len(opts)], WithMaxUses(5)),
+		append(opts[:len(opts):len(opts)], WithHealthCheck(HealthCheck{Interval: time.Hour, FailThreshold: 1})),
+		append(opts[:len(opts):len(opts)], WithBalancer(BalanceP2C{})),
+		append(opts[:len(opts):len(opts)], WithTLS(&tls.Config{ServerName: "b", NextProtos: []string{"h2"}})),
+		append(opts[:len(opts):len(opts)], WithTLS(&tls.Config{ServerName: "a", NextProtos: []string{"h2"}, InsecureSkipVerify: true})),
+	}
+	for i, opts := range conflicts {
+		if err := cm.AddServer(1, DEFAULT_CONNSRV_IP_ADDR, opts...); err == nil || err.Error() != ERROR_CONFLICT_SERVER_INFO {
+			t.Error("Other options should conflict, case ", i)
+		}
+	}
+
+	t.Log("TestAddServerOptions: End Testing")
+}
+
+func TestConnCircuitBreaker(t *testing.T) {
+	t.Log("TestConnCircuitBreaker: Start Testing")
+	//A port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	cm.AddServer(1, addr, WithCircuitBreaker(BreakerConfig{Threshold: 2, CoolDown: time.Minute}))
+	for i := 0; i < 2; i++ {
+		if _, err := cm.Get(1); err == nil {
+			t.Fatal("Dial a closed port should fail")
+		}
+	}
+	if cm.CircuitState(1) != CircuitOpen {
+		t.Error("The circuit should be open, state ", cm.CircuitState(1))
+	}
+	if _, err := cm.Get(1); err == nil || err.Error() != ERROR_CIRCUIT_OPEN {
+		t.Error("The open circuit should fail fast, got ", err)
+	}
+
+	t.Log("TestConnCircuitBreaker: End Testing")
+}
+
+func TestConnDialRetry(t *testing.T) {
+	t.Log("TestConnDialRetry: Start Testing")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(1, addr, WithRetry(RetryPolicy{MaxAttempts: 20, BaseBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}))
+
+	//The server comes back while Get retries
+	ready := make(chan net.Listener)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			close(ready)
+			return
+		}
+		ready <- l
+	}()
+
+	c, err := cm.Get(1)
+	if l, ok := <-ready; ok {
+		defer l.Close()
+	} else {
+		t.Skip("the port is taken")
+	}
+	if err != nil {
+		t.Fatal("The refused dials should be retried ", err)
+	}
+	cm.Put(1, c)
+
+	t.Log("TestConnDialRetry: End Testing")
+}
+
+func TestConnIdleCheck(t *testing.T) {
+	t.Log("TestConnIdleCheck: Start Testing")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(1, l.Addr().String())
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := cm.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	var peers []net.Conn
+	for i := 0; i < 3; i++ {
+		peers = append(peers, <-accepted)
+	}
+	for _, c := range conns {
+		cm.Put(1, c)
+	}
+
+	//One reset by the peer, one sent unexpected data
+	peers[0].Close()
+	peers[1].Write([]byte("x"))
+	defer peers[1].Close()
+	defer peers[2].Close()
+
+	cm.SetIdleCheck(20 * time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	if idleCnt(cm, 1) != 1 {
+		t.Error("The dead connections should be closed, idle ", idleCnt(cm, 1))
+	}
+	if health := cm.IdleHealth(1); health.Dead != 2 {
+		t.Error("The idle check should find two dead, found ", health.Dead)
+	}
+	if c, err := cm.Get(1); err != nil || c != conns[2] {
+		t.Error("The living connection should be kept")
+	}
+
+	t.Log("TestConnIdleCheck: End Testing")
+}
+
+func TestServerHealthCheck(t *testing.T) {
+	t.Log("TestServerHealthCheck: Start Testing")
+	l := newTestListener(t, "127.0.0.1:0")
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	var down int32
+	checkErr := errors.New("down")
+	cm.AddServer(1, l.Addr().String(), WithHealthCheck(HealthCheck{
+		Interval:      10 * time.Millisecond,
+		FailThreshold: 2,
+		PassThreshold: 3,
+		Check: func(ctx context.Context, network, address string) error {
+			if atomic.LoadInt32(&down) == 1 {
+				return checkErr
+			}
+			return dialCheck(ctx, network, address)
+		},
+	}))
+
+	c, err := cm.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inUse, err := cm.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Put(1, c)
+
+	//Ejected, the idle ones closed
+	atomic.StoreInt32(&down, 1)
+	time.Sleep(60 * time.Millisecond)
+	health, _ := cm.Health(1)
+	if health.Healthy || health.LastErr != checkErr || health.Failures < 2 {
+		t.Error("The server should be unhealthy ", health)
+	}
+	if idleCnt(cm, 1) != 0 {
+		t.Error("The idle connections of the unhealthy server should be closed")
+	}
+	if _, err := cm.Get(1); err == nil || err.Error() != ERROR_SERVER_UNHEALTHY {
+		t.Error("Get of the unhealthy server should fail fast, got ", err)
+	}
+	cm.Put(1, inUse)
+	if idleCnt(cm, 1) != 0 || cm.DiscardCount(1, DiscardStale) != 1 {
+		t.Error("The connection put back to the unhealthy server should be closed")
+	}
+
+	//Admitted again
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	if health, _ := cm.Health(1); !health.Healthy || health.Successes < 3 {
+		t.Error("The server should be healthy again ", health)
+	}
+	if _, err := cm.Get(1); err != nil {
+		t.Error("Get of the healthy server failed ", err)
+	}
+
+	if _, err := cm.Health(2); err == nil || err.Error() != ERROR_NO_EXIST_SERVER {
+		t.Error("Health of unknown server should fail")
+	}
+
+	t.Log("TestServerHealthCheck: End Testing")
+}
+
+func TestConnDeadline(t *testing.T) {
+	t.Log("TestConnDeadline: Start Testing")
+	l := newTestListener(t, "127.0.0.1:0")
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(1, l.Addr().String())
+	cm.AddServer(2, l.Addr().String(), WithDeadline(20*time.Millisecond))
+
+	//A stale deadline left by the borrower is cleared
+	c, _ := cm.Get(1)
+	c.SetDeadline(time.Now().Add(-time.Second))
+	cm.Put(1, c)
+	c, _ = cm.Get(1)
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := c.Read(buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Error("The deadline should be cleared by Put, read returned ", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Close()
+
+	//The default deadline of the server
+	c, _ = cm.Get(2)
+	start := time.Now()
+	buf := make([]byte, 1)
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) || time.Since(start) > time.Second {
+		t.Error("The default deadline should be set on checkout, got ", err)
+	}
+	cm.Discard(c)
+
+	t.Log("TestConnDeadline: End Testing")
+}
+
+func TestConnHooks(t *testing.T) {
+	t.Log("TestConnHooks: Start Testing")
+	l := newTestListener(t, "127.0.0.1:0")
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	var checkouts, returns int32
+	var failReturn, failCheckout int32
+	hookErr := errors.New("reset failed")
+	cm.AddServer(1, l.Addr().String(),
+		WithOnCheckout(func(c net.Conn) error {
+			atomic.AddInt32(&checkouts, 1)
+			if atomic.LoadInt32(&failCheckout) == 1 {
+				return hookErr
+			}
+			return nil
+		}),
+		WithOnReturn(func(c net.Conn) error {
+			atomic.AddInt32(&returns, 1)
+			if atomic.LoadInt32(&failReturn) == 1 {
+				return hookErr
+			}
+			return nil
+		}))
+
+	c, _ := cm.Get(1)
+	cm.Put(1, c)
+	if checkouts != 1 || returns != 1 || idleCnt(cm, 1) != 1 {
+		t.Error("The hooks should run on checkout and return ", checkouts, returns)
+	}
+
+	//A failed return hook closes the connection
+	c, _ = cm.Get(1)
+	atomic.StoreInt32(&failReturn, 1)
+	cm.Put(1, c)
+	if idleCnt(cm, 1) != 0 {
+		t.Error("The connection failing the return hook should not be pooled")
+	}
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Error("The connection failing the return hook should be closed")
+	}
+
+	//A failed checkout hook closes the connection and fails Get
+	atomic.StoreInt32(&failCheckout, 1)
+	if c, err := cm.Get(1); err != hookErr || c != nil {
+		t.Error("The checkout hook error should be returned, got ", err)
+	}
+
+	t.Log("TestConnHooks: End Testing")
+}
+
+func TestConnOnConnect(t *testing.T) {
+	t.Log("TestConnOnConnect: Start Testing")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 5)
+				if _, err := io.ReadFull(c, buf); err == nil && string(buf) == "hello" {
+					c.Write([]byte("ready"))
+				}
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	var greeting atomic.Value
+	greeting.Store("hello")
+	cm.AddServer(1, l.Addr().String(), WithOnConnect(func(ctx context.Context, c net.Conn) error {
+		c.Write([]byte(greeting.Load().(string)))
+		c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		defer c.SetReadDeadline(time.Time{})
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		return nil
+	}))
+
+	c, err := cm.Get(1)
+	if err != nil {
+		t.Fatal("The hello exchange should pass ", err)
+	}
+	cm.Put(1, c)
+	if c2, _ := cm.Get(1); c2 != c {
+		t.Error("The ready connection should be pooled")
+	}
+
+	//A failed exchange is a distinct error
+	greeting.Store("wrong")
+	_, err = cm.Get(1)
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("The hook error should be returned as a ConnectError, got ", err)
+	}
+	if idleCnt(cm, 1) != 0 {
+		t.Error("The failed connection should not be pooled")
+	}
+
+	t.Log("TestConnOnConnect: End Testing")
+}
+
+func TestConnUnreadCheck(t *testing.T) {
+	t.Log("TestConnUnreadCheck: Start Testing")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(1, l.Addr().String(), WithUnreadCheck())
+
+	//Clean connection is pooled
+	c, _ := cm.Get(1)
+	peer := <-accepted
+	defer peer.Close()
+	cm.Put(1, c)
+	if idleCnt(cm, 1) != 1 {
+		t.Error("The clean connection should be pooled")
+	}
+
+	//Response left unread
+	c, _ = cm.Get(1)
+	peer.Write([]byte("response"))
+	time.Sleep(10 * time.Millisecond)
+	cm.Put(1, c)
+	if idleCnt(cm, 1) != 0 || cm.DiscardCount(1, DiscardUnread) != 1 {
+		t.Error("The connection with unread data should be discarded")
+	}
+
+	//Closed by the peer
+	c, _ = cm.Get(1)
+	(<-accepted).Close()
+	time.Sleep(10 * time.Millisecond)
+	cm.Put(1, c)
+	if idleCnt(cm, 1) != 0 || cm.DiscardCount(1, DiscardUnread) != 2 {
+		t.Error("The connection closed by the peer should be discarded")
+	}
+
+	//Other reasons are counted apart
+	c, _ = cm.Get(1)
+	defer (<-accepted).Close()
+	cm.Discard(c)
+	if cm.DiscardCount(1, DiscardCaller) != 1 || cm.DiscardCount(1, DiscardUnread) != 2 {
+		t.Error("The discard by the caller is counted wrong")
+	}
+
+	t.Log("TestConnUnreadCheck: End Testing")
+}
+
+func TestServers(t *testing.T) {
+	t.Log("TestServers: Start Testing")
+	l := newTestListener(t, "127.0.0.1:0")
+	addr := l.Addr().String()
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(3, addr)
+	cm.AddServer(1, addr, WithCircuitBreaker(BreakerConfig{}))
+
+	c1, _ := cm.Get(1)
+	c2, _ := cm.Get(1)
+	cm.Put(1, c1)
+
+	servers := cm.Servers()
+	if len(servers) != 2 || servers[0].ID != 1 || servers[1].ID != 3 {
+		t.Fatal("Servers should list every server by id ", servers)
+	}
+	s := servers[0]
+	if s.Network != "tcp" || len(s.Addrs) != 1 || s.Addrs[0] != addr || s.TLS {
+		t.Error("The address of the server is wrong ", s)
+	}
+	if s.Idle != 1 || s.InUse != 1 || !s.Health.Healthy || s.Circuit != CircuitClosed {
+		t.Error("The pool of the server is wrong ", s)
+	}
+
+	cm.Discard(c2)
+	if s, err := cm.Server(1); err != nil || s.InUse != 0 || s.Discards[DiscardCaller] != 1 {
+		t.Error("Server should show the discard ", s, err)
+	}
+	if _, err := cm.Server(2); err == nil || err.Error() != ERROR_NO_EXIST_SERVER {
+		t.Error("Server of unknown id should fail")
+	}
+
+	//Safe with Get and Put running
+	var wg sync.WaitGroup
+	stop := int32(0)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&stop) == 0 {
+			if c, err := cm.Get(3); err == nil {
+				cm.Put(3, c)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		cm.Servers()
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	t.Log("TestServers: End Testing")
+}
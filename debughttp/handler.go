@@ -0,0 +1,210 @@
+//Package debughttp serves the live state of a ConnMap for debugging,
+//as JSON and as a simple HTML page
+package debughttp
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	srv "github.com/magictour/ConnectPool"
+)
+
+//The state of the ConnMap as rendered
+type view struct {
+	Time    time.Time    `json:"time"`
+	Shrink  shrinkView   `json:"shrink"`
+	Servers []serverView `json:"servers"`
+}
+
+type shrinkView struct {
+	Runs       uint64    `json:"runs"`
+	Closed     uint64    `json:"closed"`
+	LastRun    time.Time `json:"last_run"`
+	LastClosed int       `json:"last_closed"`
+	Threshold  int       `json:"threshold"`
+}
+
+type serverView struct {
+	ID        uint16   `json:"id"`
+	Network   string   `json:"network"`
+	Addrs     []string `json:"addrs"`
+	Endpoints []string `json:"endpoints"`
+	TLS       bool     `json:"tls"`
+	Idle      int      `json:"idle"`
+	InUse     int      `json:"in_use"`
+	//seconds the oldest idle connection has been idle, 0 if none idle
+	OldestIdleAge float64           `json:"oldest_idle_age"`
+	Healthy       bool              `json:"healthy"`
+	Circuit       string            `json:"circuit"`
+	Discards      map[string]uint64 `json:"discards"`
+	DialErrors    []dialErrorView   `json:"dial_errors"`
+}
+
+type dialErrorView struct {
+	Time     time.Time `json:"time"`
+	Endpoint string    `json:"endpoint"`
+	Err      string    `json:"error"`
+}
+
+//Serve the state of the ConnMap. GET renders the HTML page, or JSON with
+//format=json or an Accept of application/json. POST runs an action, refused
+//with 403 when a browser sends it from another site:
+//action=drain&id=N closes the idle connections of server N,
+//action=shrink&idle=N closes the idle connections over N, chosen by the eviction policy
+func Handler(m *srv.ConnMap) http.Handler {
+	return &handler{m: m}
+}
+
+type handler struct {
+	m *srv.ConnMap
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.serveState(w, r)
+	case http.MethodPost:
+		h.serveAction(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) serveState(w http.ResponseWriter, r *http.Request) {
+	v := h.snapshot()
+	if r.URL.Query().Get("format") == "json" || r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page.Execute(w, v)
+}
+
+func (h *handler) serveAction(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "drain":
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 16)
+		if err != nil {
+			http.Error(w, "bad server id", http.StatusBadRequest)
+			return
+		}
+		if err := h.m.DrainServer(uint16(id)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	case "shrink":
+		idle, err := strconv.ParseUint(r.FormValue("idle"), 10, 31)
+		if err != nil {
+			http.Error(w, "bad idle count", http.StatusBadRequest)
+			return
+		}
+		h.m.ShrinkTo(int(idle))
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	//back to the page the form was posted from
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+//Check whether the POST comes from a page of this host, not from a page of another
+//site open in the same browser. Clients other than browsers send neither header
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+//Take the state of the ConnMap
+func (h *handler) snapshot() view {
+	now := time.Now()
+	shrink := h.m.ShrinkStats()
+	v := view{
+		Time: now,
+		Shrink: shrinkView{
+			Runs:       shrink.Runs,
+			Closed:     shrink.Closed,
+			LastRun:    shrink.LastRun,
+			LastClosed: shrink.LastClosed,
+			Threshold:  shrink.Threshold,
+		},
+	}
+
+	for _, s := range h.m.Servers() {
+		sv := serverView{
+			ID:        s.ID,
+			Network:   s.Network,
+			Addrs:     s.Addrs,
+			Endpoints: s.Endpoints,
+			TLS:       s.TLS,
+			Idle:      s.Idle,
+			InUse:     s.InUse,
+			Healthy:   s.Health.Healthy,
+			Circuit:   s.Circuit.String(),
+			Discards:  make(map[string]uint64, len(s.Discards)),
+		}
+		if !s.OldestIdle.IsZero() {
+			sv.OldestIdleAge = now.Sub(s.OldestIdle).Seconds()
+		}
+		for reason, n := range s.Discards {
+			sv.Discards[reason.String()] = n
+		}
+		for _, e := range s.DialErrors {
+			sv.DialErrors = append(sv.DialErrors, dialErrorView{Time: e.Time, Endpoint: e.Endpoint, Err: e.Err.Error()})
+		}
+		v.Servers = append(v.Servers, sv)
+	}
+	return v
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><title>ConnectPool</title></head>
+<body>
+<h1>ConnectPool</h1>
+<p>{{.Time.Format "2006-01-02 15:04:05"}}</p>
+<h2>Shrink</h2>
+<p>runs {{.Shrink.Runs}}, closed {{.Shrink.Closed}}, last closed {{.Shrink.LastClosed}}, threshold {{.Shrink.Threshold}}</p>
+<form method="post"><input type="hidden" name="action" value="shrink">idle connections to keep <input type="number" name="idle" min="0" value="{{.Shrink.Threshold}}"> <button>Shrink now</button></form>
+<h2>Servers</h2>
+<table border="1" cellpadding="4">
+<tr><th>id</th><th>address</th><th>endpoints</th><th>idle</th><th>in use</th><th>oldest idle (s)</th><th>healthy</th><th>circuit</th><th>discards</th><th>recent dial errors</th><th></th></tr>
+{{range .Servers}}<tr>
+<td>{{.ID}}</td>
+<td>{{.Network}} {{range .Addrs}}{{.}} {{end}}{{if .TLS}}(tls){{end}}</td>
+<td>{{range .Endpoints}}{{.}}<br>{{end}}</td>
+<td>{{.Idle}}</td>
+<td>{{.InUse}}</td>
+<td>{{printf "%.1f" .OldestIdleAge}}</td>
+<td>{{.Healthy}}</td>
+<td>{{.Circuit}}</td>
+<td>{{range $reason, $n := .Discards}}{{$reason}}: {{$n}}<br>{{end}}</td>
+<td>{{range .DialErrors}}{{.Time.Format "15:04:05"}} {{.Endpoint}}: {{.Err}}<br>{{end}}</td>
+<td><form method="post"><input type="hidden" name="action" value="drain"><input type="hidden" name="id" value="{{.ID}}"><button>Drain</button></form></td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
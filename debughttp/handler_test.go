@@ -0,0 +1,169 @@
+package debughttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	srv "github.com/magictour/ConnectPool"
+)
+
+func TestHandler(t *testing.T) {
+	t.Log("TestHandler: Start Testing")
+	//a plain tcp peer, its connections are closed with it
+	peer := httptest.NewServer(http.NotFoundHandler())
+	defer peer.Close()
+
+	cm := srv.NewConnMap(50)
+	cm.Start()
+	defer cm.ShutDown()
+	cm.AddServer(1, peer.Listener.Addr().String())
+	//nobody listens on port 1
+	cm.AddServer(2, "127.0.0.1:1")
+
+	c, err := cm.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Put(1, c)
+	cm.Get(2)
+
+	ts := httptest.NewServer(Handler(cm))
+	defer ts.Close()
+
+	//JSON
+	resp, err := http.Get(ts.URL + "?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v view
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	resp.Body.Close()
+	if err != nil || len(v.Servers) != 2 {
+		t.Fatal("Should list the servers as JSON ", err)
+	}
+	if s := v.Servers[0]; s.ID != 1 || s.Idle != 1 || s.InUse != 0 || s.OldestIdleAge <= 0 || !s.Healthy {
+		t.Error("The server is rendered wrong ", s)
+	}
+	if s := v.Servers[1]; len(s.DialErrors) != 1 || s.DialErrors[0].Endpoint != "127.0.0.1:1" {
+		t.Error("The dial error should be rendered ", s)
+	}
+
+	//HTML
+	resp, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "127.0.0.1:1") {
+		t.Error("Should render the servers as HTML")
+	}
+	if idle := fmt.Sprintf(`name="idle" min="0" value="%d"`, cm.ShrinkStats().Threshold); !strings.Contains(string(body), idle) {
+		t.Error("The shrink form should default to the threshold")
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	//Refused from the page of another site
+	for _, header := range []http.Header{
+		{"Origin": {"http://evil.example"}},
+		{"Origin": {"null"}},
+		{"Sec-Fetch-Site": {"cross-site"}, "Origin": {ts.URL}},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("action=drain&id=1"))
+		req.Header = header
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Error("The cross-site action should be refused ", header, resp.StatusCode)
+		}
+	}
+	if s, _ := cm.Server(1); s.Idle != 1 {
+		t.Error("The refused drain should close nothing, idle ", s.Idle)
+	}
+
+	//Drain server 1 from the page itself
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("action=drain&id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", ts.URL)
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Error("Drain should redirect to the page, status ", resp.StatusCode)
+	}
+	if s, _ := cm.Server(1); s.Idle != 0 {
+		t.Error("Drain should close the idle connections, idle ", s.Idle)
+	}
+
+	//Bad actions
+	for _, form := range []url.Values{
+		{"action": {"drain"}, "id": {"x"}},
+		{"action": {"drain"}, "id": {"3"}},
+		{"action": {"reboot"}},
+		{"action": {"shrink"}},
+		{"action": {"shrink"}, "idle": {"-1"}},
+	} {
+		resp, err := client.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 400 {
+			t.Error("The bad action should fail ", form)
+		}
+	}
+
+	//Shrink to 1 idle connection, far under the threshold of the shrink daemon
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := cm.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		cm.Put(1, c)
+	}
+	resp, err = client.PostForm(ts.URL, url.Values{"action": {"shrink"}, "idle": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Error("Shrink should redirect to the page, status ", resp.StatusCode)
+	}
+	closed := 0
+	for _, c := range conns {
+		if err := c.SetDeadline(time.Time{}); errors.Is(err, net.ErrClosed) {
+			closed++
+		}
+	}
+	if s, _ := cm.Server(1); closed != 2 || s.Idle != 1 {
+		t.Error("Shrink should close the idle connections over the count, closed ", closed, " idle ", s.Idle)
+	}
+	if shrink := cm.ShrinkStats(); shrink.Runs == 0 || shrink.LastClosed != 2 || shrink.Closed < 2 {
+		t.Error("Shrink should be counted as a shrink run ", shrink)
+	}
+
+	t.Log("TestHandler: End Testing")
+}
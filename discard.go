@@ -0,0 +1,60 @@
+package srv
+
+//Why a resource was closed instead of pooled
+type DiscardReason int
+
+const (
+	//Closed by the caller, with Discard or found closed after a Get
+	DiscardCaller DiscardReason = iota
+	//Created before an Expire or by a removed endpoint, or put back to an ejected server
+	DiscardStale
+	//Found closed or broken, by the idle probe or a failed setup
+	DiscardDead
+	//Put back with unread data or closed by the peer
+	DiscardUnread
+	//Failed a checkout or return hook
+	DiscardHook
+	//Reached the max uses of its key
+	DiscardRetired
+
+	discardReasons
+)
+
+func (r DiscardReason) String() string {
+	switch r {
+	case DiscardCaller:
+		return "caller"
+	case DiscardStale:
+		return "stale"
+	case DiscardDead:
+		return "dead"
+	case DiscardUnread:
+		return "unread"
+	case DiscardHook:
+		return "hook"
+	case DiscardRetired:
+		return "retired"
+	}
+	return "unknown"
+}
+
+//How many resources of the key were discarded for the reason
+func (p *Pool[K, R]) DiscardCount(key K, reason DiscardReason) uint64 {
+	if reason < 0 || reason >= discardReasons {
+		return 0
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return 0
+	}
+	return kp.discards[reason]
+}
+
+//Close the resource taken by Get instead of putting it back, counted for the reason
+func (p *Pool[K, R]) discard(r R, reason DiscardReason) {
+	p.releaseCheckouts([]R{r}, reason)
+	r.Close()
+}
@@ -0,0 +1,231 @@
+package srv
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//Servers added by hostname get one endpoint per resolved address,
+//the resolve deamon keeps the endpoints in line with the DNS
+
+const DefaultResolveSpan = 30   //Second
+const DefaultResolveTimeout = 5 //Second
+
+//Look up the addresses of a host, *net.Resolver is one
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+//One endpoint address of a server
+type serverAddr struct {
+	addr string
+	//host and port of a tcp address
+	host string
+	port uint16
+	//the host is a name to resolve, with one endpoint per address
+	resolve bool
+	//the ip network to look the host up in
+	lookupNetwork string
+}
+
+//Split the tcp address and check whether the host is a name to resolve
+func newServerAddr(network, addr string) *serverAddr {
+	a := &serverAddr{addr: addr}
+	switch network {
+	case "tcp4":
+		a.lookupNetwork = "ip4"
+	case "tcp6":
+		a.lookupNetwork = "ip6"
+	case "tcp":
+		a.lookupNetwork = "ip"
+	default:
+		return a
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return a
+	}
+	a.host = host
+
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		//service name, leave it to the dialer
+		return a
+	}
+	a.port = uint16(portNum)
+
+	if _, err := netip.ParseAddr(host); err == nil || host == "" {
+		return a
+	}
+	a.resolve = true
+	return a
+}
+
+//Look up the host and return the endpoint addresses
+func (a *serverAddr) lookup(resolver Resolver) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultResolveTimeout*time.Second)
+	defer cancel()
+
+	ips, err := resolver.LookupNetIP(ctx, a.lookupNetwork, a.host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), a.port).String())
+	}
+	return addrs, nil
+}
+
+//Resolve every endpoint address of the server, the literal ones are kept as is.
+//Return the endpoints sorted by name, nil if any lookup fails or finds nothing
+func (cp *ConnPool) lookup(resolver Resolver) []Endpoint[net.Conn] {
+	var eps []Endpoint[net.Conn]
+	for _, a := range cp.addrs {
+		if !a.resolve {
+			eps = append(eps, Endpoint[net.Conn]{Name: a.addr, Factory: cp.dialer(a.addr, "")})
+			continue
+		}
+
+		addrs, err := a.lookup(resolver)
+		if err != nil || len(addrs) == 0 {
+			return nil
+		}
+		for _, addr := range addrs {
+			eps = append(eps, Endpoint[net.Conn]{Name: addr, Factory: cp.dialer(addr, a.host)})
+		}
+	}
+
+	sort.SliceStable(eps, func(i, j int) bool {
+		return eps[i].Name < eps[j].Name
+	})
+
+	//drop the duplicated ones
+	n := 0
+	for i := range eps {
+		if i == 0 || eps[i].Name != eps[n-1].Name {
+			eps[n] = eps[i]
+			n++
+		}
+	}
+	return eps[:n]
+}
+
+//Check whether the endpoints differ from the ones last resolved
+func (cp *ConnPool) resolvedChanged(eps []Endpoint[net.Conn]) bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	if len(eps) != len(cp.resolved) {
+		return true
+	}
+
+	for i := range eps {
+		if eps[i].Name != cp.resolved[i] {
+			return true
+		}
+	}
+	return false
+}
+
+//Set the resolver of the servers added by hostname, nil for net.DefaultResolver
+func (p *ConnMap) SetResolver(resolver Resolver) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	p.lock.Lock()
+	p.resolver = resolver
+	p.lock.Unlock()
+	p.notifyResolve()
+}
+
+//Set how often the servers added by hostname are resolved again
+func (p *ConnMap) SetResolveInterval(span time.Duration) {
+	if span <= 0 {
+		span = DefaultResolveSpan * time.Second
+	}
+
+	p.lock.Lock()
+	p.resolveSpan = span
+	p.lock.Unlock()
+	p.notifyResolve()
+}
+
+//Wake the resolve deamon up
+func (p *ConnMap) notifyResolve() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.notifyResolveLocked()
+}
+
+//Wake the resolve deamon up, the caller must hold the lock
+func (p *ConnMap) notifyResolveLocked() {
+	select {
+	case p.resolveChan <- true:
+	//signal already pending or no deamon running
+	default:
+	}
+}
+
+//Resolve daemon for the servers added by hostname
+func (p *ConnMap) resolveDaemon(resolveChan chan bool) {
+	for {
+		p.lock.Lock()
+		span := p.resolveSpan
+		p.lock.Unlock()
+
+		select {
+		//Receive resolve signal
+		case _, ok := <-resolveChan:
+			//Channel close
+			if !ok {
+				return
+			}
+		//Time out for resolve
+		case <-time.After(span):
+		}
+
+		p.resolveAll()
+	}
+}
+
+//Resolve every server added by hostname and update its endpoints.
+//A failed lookup keeps the endpoints, the addresses gone from the DNS are drained
+func (p *ConnMap) resolveAll() {
+	p.lock.Lock()
+	resolver := p.resolver
+	var cps []*ConnPool
+	for _, cp := range p.cm {
+		if cp != nil && cp.resolve {
+			cps = append(cps, cp)
+		}
+	}
+	p.lock.Unlock()
+
+	for _, cp := range cps {
+		eps := cp.lookup(resolver)
+		if len(eps) == 0 || !cp.resolvedChanged(eps) {
+			continue
+		}
+
+		addrs := make([]string, 0, len(eps))
+		for _, ep := range eps {
+			addrs = append(addrs, ep.Name)
+		}
+
+		p.lock.Lock()
+		//still the same server
+		if p.cm[cp.id] == cp && p.pool.SetEndpoints(cp.id, eps) == nil {
+			cp.lock.Lock()
+			cp.resolved = addrs
+			cp.lock.Unlock()
+		}
+		p.lock.Unlock()
+	}
+}
@@ -0,0 +1,111 @@
+package srv
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Resolver answering from a fixed list
+type fakeResolver struct {
+	lock  sync.Mutex
+	addrs []netip.Addr
+}
+
+func (r *fakeResolver) set(addrs ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.addrs = r.addrs[:0]
+	for _, a := range addrs {
+		r.addrs = append(r.addrs, netip.MustParseAddr(a))
+	}
+}
+
+func (r *fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]netip.Addr(nil), r.addrs...), nil
+}
+
+//Wait until the server has the endpoint count
+func waitEndpoints(m *ConnMap, id uint16, n int) bool {
+	for i := 0; i < 100; i++ {
+		if len(m.pool.Endpoints(id)) == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestResolveServer(t *testing.T) {
+	t.Log("TestResolveServer: Start Testing")
+	l := newTestListener(t, ":0")
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	//only loopback 127.0.0.1 is set up on some systems such as macOS
+	c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.2", port), time.Second)
+	if err != nil {
+		t.Skip("127.0.0.2 is not reachable: ", err)
+	}
+	c.Close()
+
+	resolver := &fakeResolver{}
+	resolver.set("127.0.0.1", "127.0.0.2", "127.0.0.1")
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.SetResolver(resolver)
+	cm.SetResolveInterval(20 * time.Millisecond)
+	cm.Start()
+	defer cm.ShutDown()
+
+	if err := cm.AddServer(1, "pool.test:"+port); err != nil {
+		t.Fatal(err)
+	}
+	if !waitEndpoints(cm, 1, 2) {
+		t.Fatal("Should get one endpoint per address ", cm.pool.Endpoints(1))
+	}
+
+	//Connections are spread over the addresses
+	hosts := map[string][]net.Conn{}
+	for i := 0; i < 4; i++ {
+		c, err := cm.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		hosts[host] = append(hosts[host], c)
+	}
+	if len(hosts["127.0.0.1"]) != 2 || len(hosts["127.0.0.2"]) != 2 {
+		t.Error("Connections should be spread over the addresses ", len(hosts["127.0.0.1"]), len(hosts["127.0.0.2"]))
+	}
+	cm.Put(1, hosts["127.0.0.2"][0])
+	cm.Put(1, hosts["127.0.0.1"][0])
+
+	//The address gone from the DNS is drained
+	resolver.set("127.0.0.1")
+	if !waitEndpoints(cm, 1, 1) {
+		t.Fatal("The gone address should be removed ", cm.pool.Endpoints(1))
+	}
+	if idleCnt(cm, 1) != 1 {
+		t.Error("The idle connection of the gone address should be closed, idle ", idleCnt(cm, 1))
+	}
+	cm.Put(1, hosts["127.0.0.2"][1])
+	cm.Put(1, hosts["127.0.0.1"][1])
+	if idleCnt(cm, 1) != 2 {
+		t.Error("The connection of the gone address should be closed when put back, idle ", idleCnt(cm, 1))
+	}
+
+	//A literal address is not resolved
+	if err := cm.AddServer(2, "127.0.0.1:"+port); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if eps := cm.pool.Endpoints(2); len(eps) != 1 || eps[0] != "127.0.0.1:"+port {
+		t.Error("The literal address should be the only endpoint ", eps)
+	}
+
+	t.Log("TestResolveServer: End Testing")
+}
@@ -0,0 +1,3 @@
+module github.com/magictour/ConnectPool
+
+go 1.20
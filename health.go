@@ -0,0 +1,189 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+//Active health check: a server failing its checks is ejected, Get fails fast
+//with ERROR_SERVER_UNHEALTHY and its idle connections, the ones put back included,
+//are closed until it passes again
+
+const DefaultHealthCheckSpan = 10   //Second
+const DefaultHealthCheckTimeout = 2 //Second
+const DefaultHealthFailThreshold = 3
+const DefaultHealthPassThreshold = 2
+
+//Health check settings of a server
+type HealthCheck struct {
+	//how often the server is checked, DefaultHealthCheckSpan if 0
+	Interval time.Duration
+	//time limit of one check, DefaultHealthCheckTimeout if 0
+	Timeout time.Duration
+	//consecutive failed checks ejecting the server, DefaultHealthFailThreshold if 0
+	FailThreshold int
+	//consecutive passed checks admitting it again, DefaultHealthPassThreshold if 0
+	PassThreshold int
+	//check one endpoint address of the server, a tcp connect if nil.
+	//The check passes if any endpoint passes
+	Check func(ctx context.Context, network, address string) error
+}
+
+//Health status of a server
+type ServerHealth struct {
+	Healthy bool
+	//consecutive failed and passed checks
+	Failures  int
+	Successes int
+	//when the server was last checked
+	LastCheck time.Time
+	//the error of the last failed check
+	LastErr error
+}
+
+//Check the server at the interval, ejecting it after the failures in a row
+//and admitting it again after the passes in a row
+func WithHealthCheck(hc HealthCheck) ServerOption {
+	return func(cp *ConnPool) {
+		if hc.Interval <= 0 {
+			hc.Interval = DefaultHealthCheckSpan * time.Second
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = DefaultHealthCheckTimeout * time.Second
+		}
+		if hc.FailThreshold <= 0 {
+			hc.FailThreshold = DefaultHealthFailThreshold
+		}
+		if hc.PassThreshold <= 0 {
+			hc.PassThreshold = DefaultHealthPassThreshold
+		}
+		cp.healthCheck = &hc
+	}
+}
+
+//Check whether both settings are the same, Check by whether it is set
+func (hc *HealthCheck) same(other *HealthCheck) bool {
+	if hc == nil || other == nil {
+		return hc == other
+	}
+
+	return hc.Interval == other.Interval && hc.Timeout == other.Timeout &&
+		hc.FailThreshold == other.FailThreshold && hc.PassThreshold == other.PassThreshold &&
+		(hc.Check == nil) == (other.Check == nil)
+}
+
+//Check the address by a connect
+func dialCheck(ctx context.Context, network, address string) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+//Check whether Get may dial the server
+func (cp *ConnPool) isHealthy() bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.health.Healthy
+}
+
+//Start the health check loop of the server, the caller must hold the ConnMap lock
+func (p *ConnMap) startHealthCheck(cp *ConnPool) {
+	if cp.healthCheck == nil {
+		return
+	}
+
+	cp.healthStop = make(chan struct{})
+	go p.healthCheckLoop(cp, cp.healthStop)
+}
+
+//Stop the health check loop of the server, the caller must hold the ConnMap lock
+func (p *ConnMap) stopHealthCheck(cp *ConnPool) {
+	if cp.healthStop != nil {
+		close(cp.healthStop)
+		cp.healthStop = nil
+	}
+}
+
+//Health check loop of the server
+func (p *ConnMap) healthCheckLoop(cp *ConnPool, stop chan struct{}) {
+	ticker := time.NewTicker(cp.healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.checkHealth(cp)
+	}
+}
+
+//Check every endpoint of the server until one passes and update its status
+func (p *ConnMap) checkHealth(cp *ConnPool) {
+	hc := cp.healthCheck
+	check := hc.Check
+	if check == nil {
+		check = dialCheck
+	}
+
+	var err error
+	for _, addr := range p.pool.Endpoints(cp.id) {
+		ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+		err = check(ctx, cp.network, addr)
+		cancel()
+		if err == nil {
+			break
+		}
+	}
+
+	cp.lock.Lock()
+	health := &cp.health
+	health.LastCheck = time.Now()
+	ejected := false
+	if err != nil {
+		health.Failures++
+		health.Successes = 0
+		health.LastErr = err
+		if health.Healthy && health.Failures >= hc.FailThreshold {
+			health.Healthy = false
+			ejected = true
+		}
+	} else {
+		health.Successes++
+		health.Failures = 0
+		if !health.Healthy && health.Successes >= hc.PassThreshold {
+			health.Healthy = true
+		}
+	}
+	cp.lock.Unlock()
+
+	if ejected {
+		p.CloseConnPool(cp)
+	}
+}
+
+//Health status of the server, a server without health check is always healthy
+func (p *ConnMap) Health(id uint16) (health ServerHealth, err error) {
+	if id >= DefaultMaxServers {
+		err = errors.New(ERROR_WRONG_SERVER_ID)
+		return
+	}
+
+	p.lock.Lock()
+	cp := p.cm[id]
+	p.lock.Unlock()
+	if cp == nil {
+		err = errors.New(ERROR_NO_EXIST_SERVER)
+		return
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	return cp.health, nil
+}
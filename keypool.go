@@ -0,0 +1,207 @@
+package srv
+
+import (
+	"io"
+)
+
+//Endpoint of a key, the key spreads its resources over its endpoints
+type Endpoint[R io.Closer] struct {
+	//identity of the endpoint, the resources stay pooled while a key keeps the name
+	Name    string
+	Factory Factory[R]
+}
+
+//Idle list of one endpoint, guarded by the Pool lock
+type endpointPool[K comparable, R io.Closer] struct {
+	name    string
+	factory Factory[R]
+	list    *List[*PoolElement[K, R]]
+	//resources checked out or being created
+	busy int
+	//no longer an endpoint of the key, its resources are closed when put back
+	removed bool
+}
+
+func newEndpointPool[K comparable, R io.Closer](ep Endpoint[R]) *endpointPool[K, R] {
+	return &endpointPool[K, R]{
+		name:    ep.Name,
+		factory: ep.Factory,
+		list:    NewList[*PoolElement[K, R]](),
+	}
+}
+
+//Single key resource pool, the idle lists are guarded by the Pool lock
+type KeyPool[K comparable, R io.Closer] struct {
+	key       K
+	endpoints []*endpointPool[K, R]
+	//the endpoint the next checkout starts from
+	next int
+	//idle resource count of all endpoints
+	idle int
+	//resources checked out or being created, the ones of removed endpoints included
+	inUse int
+	//bumped by Expire, resources of an older generation are stale
+	gen uint64
+	//choose the endpoint new resources are created by
+	balancer Balancer
+	//resources created so far
+	seq uint64
+	//scratch space of the balancer
+	stats []EndpointStat
+	//fail fast on repeated dial failures, nil if disabled
+	breaker *breaker
+	//retry the failed dials, nil if disabled
+	retry *RetryPolicy
+	//dials running at once and the limit of them, 0 for no limit
+	dialing  int
+	maxDials int
+	//Gets waiting for a resource or a dial slot
+	waiters *List[*dialWaiter[K, R]]
+	//what the idle monitor found
+	health IdleHealth
+	//resources closed instead of pooled, by reason
+	discards [discardReasons]uint64
+	//checkouts a resource is retired after, 0 for no limit
+	maxUses int
+	//the last dial errors, the oldest first
+	dialErrors []DialError
+}
+
+func newKeyPool[K comparable, R io.Closer](key K, eps []Endpoint[R]) *KeyPool[K, R] {
+	kp := &KeyPool[K, R]{
+		key:      key,
+		balancer: BalanceRoundRobin{},
+		waiters:  NewList[*dialWaiter[K, R]](),
+	}
+	kp.setEndpoints(eps)
+	return kp
+}
+
+//Get idle resource count
+func (kp *KeyPool[K, R]) getIdleCnt() int {
+	return kp.idle
+}
+
+//Put resource to the idle list of its endpoint
+func (kp *KeyPool[K, R]) put(pe *PoolElement[K, R]) {
+	pe.ep.list.PushFrontElement(&pe.local)
+	kp.idle++
+}
+
+//Put resource back to the idle list of its endpoint after the element
+func (kp *KeyPool[K, R]) putAfter(pe *PoolElement[K, R], at *Element[*PoolElement[K, R]]) {
+	pe.ep.list.insert(&pe.local, at)
+	kp.idle++
+}
+
+//Remove the idle resource from the list of its endpoint
+func (kp *KeyPool[K, R]) remove(pe *PoolElement[K, R]) {
+	pe.ep.list.Remove(&pe.local)
+	kp.idle--
+}
+
+//Check whether the resource was checked out as many times as it may
+func (kp *KeyPool[K, R]) isRetired(pe *PoolElement[K, R]) bool {
+	return kp.maxUses > 0 && pe.uses >= kp.maxUses
+}
+
+//Check whether the resource was created before the last Expire
+//or its endpoint is gone
+func (kp *KeyPool[K, R]) isStale(pe *PoolElement[K, R]) bool {
+	return pe.gen != kp.gen || pe.ep.removed
+}
+
+//Get one idle resource, the endpoints are tried in turn
+func (kp *KeyPool[K, R]) get(reuse ReusePolicy) *PoolElement[K, R] {
+	n := len(kp.endpoints)
+	if kp.idle == 0 || n == 0 {
+		return nil
+	}
+
+	for i := 0; i < n; i++ {
+		ep := kp.endpoints[(kp.next+i)%n]
+		if ep.list.Len() == 0 {
+			continue
+		}
+
+		kp.next = (kp.next + i + 1) % n
+		kp.idle--
+		if reuse == ReuseFIFO {
+			return ep.list.Remove(ep.list.Back())
+		}
+
+		return ep.list.PopFront()
+	}
+
+	return nil
+}
+
+//The endpoint the next new resource is created by, chosen by the balancer, nil if none
+func (kp *KeyPool[K, R]) nextEndpoint() *endpointPool[K, R] {
+	n := len(kp.endpoints)
+	if n == 0 {
+		return nil
+	}
+
+	kp.stats = kp.stats[:0]
+	for _, ep := range kp.endpoints {
+		kp.stats = append(kp.stats, EndpointStat{Name: ep.name, Busy: ep.busy, Idle: ep.list.Len()})
+	}
+
+	pos := kp.balancer.Pick(kp.stats, kp.seq)
+	if pos < 0 || pos >= n {
+		pos = 0
+	}
+	kp.seq++
+	return kp.endpoints[pos]
+}
+
+//The endpoint resources not created by the pool are put to, nil if none
+func (kp *KeyPool[K, R]) defaultEndpoint() *endpointPool[K, R] {
+	if len(kp.endpoints) == 0 {
+		return nil
+	}
+
+	return kp.endpoints[0]
+}
+
+//Replace the endpoints, the ones keeping their name keep their idle list.
+//Return the removed ones, their idle resources are still linked
+func (kp *KeyPool[K, R]) setEndpoints(eps []Endpoint[R]) (removed []*endpointPool[K, R]) {
+	old := make(map[string]*endpointPool[K, R], len(kp.endpoints))
+	for _, ep := range kp.endpoints {
+		old[ep.name] = ep
+	}
+
+	endpoints := make([]*endpointPool[K, R], 0, len(eps))
+	seen := make(map[string]bool, len(eps))
+	for _, e := range eps {
+		if seen[e.Name] {
+			continue
+		}
+		seen[e.Name] = true
+
+		ep := old[e.Name]
+		if ep != nil {
+			delete(old, e.Name)
+			ep.factory = e.Factory
+		} else {
+			ep = newEndpointPool[K, R](e)
+		}
+		endpoints = append(endpoints, ep)
+	}
+
+	for _, ep := range old {
+		ep.removed = true
+		removed = append(removed, ep)
+	}
+
+	kp.endpoints = endpoints
+	if len(endpoints) > 0 {
+		kp.next %= len(endpoints)
+	} else {
+		kp.next = 0
+	}
+
+	return removed
+}
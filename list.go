@@ -0,0 +1,210 @@
+package srv
+
+//List Element
+type Element[T any] struct {
+	next, prev *Element[T]
+	//The value stored in the element
+	Value T
+}
+
+//Double link list,should support split and insert from front
+type List[T any] struct {
+	root Element[T]
+	len  int
+}
+
+//The untyped list kept for the callers of the connect LRU list
+type LruElement = Element[interface{}]
+type ConnLRUList = List[interface{}]
+
+//New a list and init it
+func NewList[T any]() *List[T] {
+	return new(List[T]).Init()
+}
+
+//New a connect LRU list and init it
+func NewConnLRUList() *ConnLRUList {
+	return NewList[interface{}]()
+}
+
+//Init a list
+func (cl *List[T]) Init() *List[T] {
+	cl.root.next = &cl.root
+	cl.root.prev = &cl.root
+	cl.len = 0
+	return cl
+}
+
+//Init a connect list
+func (cl *List[T]) InitConnLRUList() *List[T] {
+	return cl.Init()
+}
+
+//The length of the list
+func (cl *List[T]) Len() int {
+	return cl.len
+}
+
+//Update the length of the list
+func (cl *List[T]) SetLen(len int) {
+	if len >= 0 {
+		cl.len = len
+	}
+}
+
+//The front element of the list
+func (cl *List[T]) Front() *Element[T] {
+	if cl.len > 0 {
+		return cl.root.next
+	}
+
+	return nil
+}
+
+//The back element of the list
+func (cl *List[T]) Back() *Element[T] {
+	if cl.len > 0 {
+		return cl.root.prev
+	}
+
+	return nil
+}
+
+//Link the element after at
+func (cl *List[T]) insert(e, at *Element[T]) *Element[T] {
+	e.prev = at
+	e.next = at.next
+	at.next.prev = e
+	at.next = e
+	cl.len++
+	return e
+}
+
+//Unlink the element
+func (cl *List[T]) unlink(e *Element[T]) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.next = nil
+	e.prev = nil
+	cl.len--
+}
+
+//Push sth to the front of the list
+func (cl *List[T]) PushFront(v T) *Element[T] {
+	return cl.insert(&Element[T]{Value: v}, &cl.root)
+}
+
+//Push sth to the back of the list
+func (cl *List[T]) PushBack(v T) *Element[T] {
+	return cl.insert(&Element[T]{Value: v}, cl.root.prev)
+}
+
+//Link the element owned by the caller to the front of the list,
+//the element must not be in any list
+func (cl *List[T]) PushFrontElement(e *Element[T]) *Element[T] {
+	return cl.insert(e, &cl.root)
+}
+
+//Link the element owned by the caller to the back of the list,
+//the element must not be in any list
+func (cl *List[T]) PushBackElement(e *Element[T]) *Element[T] {
+	return cl.insert(e, cl.root.prev)
+}
+
+//Pop the front element and return the value in the element
+func (cl *List[T]) PopFront() (v T) {
+	if cl.len > 0 {
+		ve := cl.root.next
+		cl.unlink(ve)
+		return ve.Value
+	}
+
+	return
+}
+
+//Remove the specified element and return the value in it
+func (cl *List[T]) Remove(pos *Element[T]) (v T) {
+	if pos != nil && cl.len > 0 {
+		cl.unlink(pos)
+		return pos.Value
+	}
+
+	return
+}
+
+//Move the element of the list to the front
+func (cl *List[T]) MoveToFront(pos *Element[T]) {
+	if pos == nil || cl.len == 0 || cl.root.next == pos {
+		return
+	}
+
+	cl.unlink(pos)
+	cl.insert(pos, &cl.root)
+}
+
+//Call f on each value from front to back until it returns false
+func (cl *List[T]) Range(f func(v T) bool) {
+	for e := cl.root.next; e != &cl.root; {
+		//f may remove the current element
+		next := e.next
+		if !f(e.Value) {
+			return
+		}
+		e = next
+	}
+}
+
+//Call f on each value from front to back
+func (cl *List[T]) Do(f func(v T)) {
+	cl.Range(func(v T) bool {
+		f(v)
+		return true
+	})
+}
+
+//Just update list information with cut the list by position at
+func (cl *List[T]) PartitionListQuick(at *Element[T], len int, isSeq bool) *List[T] {
+	if at == nil || len < 0 {
+		return nil
+	}
+
+	pcl := NewList[T]()
+	pcl.root.next = at
+	pcl.root.prev = cl.root.prev
+	pcl.root.prev.next = &pcl.root
+
+	cl.root.prev = at.prev
+	at.prev.next = &cl.root
+
+	at.prev = &pcl.root
+
+	if isSeq {
+		pcl.len = cl.len - len
+		cl.len = len
+	} else {
+		pcl.len = len
+		cl.len = cl.len - len
+	}
+
+	return pcl
+}
+
+//Partition the list in the specified position
+func (cl *List[T]) PartitionList(pos int, isSeq bool) *List[T] {
+	if pos < 0 || cl.len < pos {
+		return nil
+	}
+
+	p := &cl.root
+	for i := 0; i < pos; i++ {
+		if isSeq {
+			p = p.next
+		} else {
+			p = p.prev
+		}
+	}
+
+	pcl := cl.PartitionListQuick(p, pos, isSeq)
+
+	return pcl
+}
@@ -0,0 +1,145 @@
+package srv
+
+import (
+	"testing"
+)
+
+//Collect the values of the list from front to back
+func listValues[T any](l *List[T]) []T {
+	var vs []T
+	l.Do(func(v T) {
+		vs = append(vs, v)
+	})
+	return vs
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListPushBack(t *testing.T) {
+	t.Log("TestListPushBack: Start Testing")
+	list := NewList[int]()
+	if list.Back() != nil {
+		t.Error("Should be empty list")
+	}
+
+	testCase := []int{1, 3, 89, 24, 45, 78, 7}
+	for _, v := range testCase {
+		list.PushBack(v)
+	}
+	if list.Len() != len(testCase) {
+		t.Error("The len is dismathed with the case")
+	}
+
+	if !equalInts(listValues(list), testCase) {
+		t.Error("The value is not equal expected", listValues(list))
+	}
+
+	//Typed list pops the zero value when empty
+	for list.Len() > 0 {
+		list.PopFront()
+	}
+	if list.PopFront() != 0 {
+		t.Error("Empty list should popfront zero")
+	}
+
+	t.Log("TestListPushBack: End Testing")
+}
+
+func TestListMoveToFront(t *testing.T) {
+	t.Log("TestListMoveToFront: Start Testing")
+	list := NewList[int]()
+	list.MoveToFront(nil)
+
+	e1 := list.PushBack(1)
+	list.PushBack(2)
+	e3 := list.PushBack(3)
+
+	list.MoveToFront(e3)
+	if !equalInts(listValues(list), []int{3, 1, 2}) {
+		t.Error("Move back to front error", listValues(list))
+	}
+
+	list.MoveToFront(e3)
+	if !equalInts(listValues(list), []int{3, 1, 2}) {
+		t.Error("Move front to front error", listValues(list))
+	}
+
+	list.MoveToFront(e1)
+	if !equalInts(listValues(list), []int{1, 3, 2}) || list.Len() != 3 {
+		t.Error("Move middle to front error", listValues(list))
+	}
+
+	t.Log("TestListMoveToFront: End Testing")
+}
+
+func TestListRange(t *testing.T) {
+	t.Log("TestListRange: Start Testing")
+	list := NewList[int]()
+	for _, v := range []int{1, 2, 3, 4, 5} {
+		list.PushBack(v)
+	}
+
+	//Stop early
+	var seen []int
+	list.Range(func(v int) bool {
+		seen = append(seen, v)
+		return v < 3
+	})
+	if !equalInts(seen, []int{1, 2, 3}) {
+		t.Error("Range should stop when f returns false", seen)
+	}
+
+	//Remove the current element while ranging
+	elems := map[int]*Element[int]{}
+	for e := list.Front(); e != nil && len(elems) < list.Len(); e = e.next {
+		elems[e.Value] = e
+	}
+	list.Range(func(v int) bool {
+		if v%2 == 0 {
+			list.Remove(elems[v])
+		}
+		return true
+	})
+	if !equalInts(listValues(list), []int{1, 3, 5}) {
+		t.Error("Remove while ranging error", listValues(list))
+	}
+
+	t.Log("TestListRange: End Testing")
+}
+
+func TestListPartitionTyped(t *testing.T) {
+	t.Log("TestListPartitionTyped: Start Testing")
+	list := NewList[int]()
+	for _, v := range []int{1, 2, 3, 4, 5} {
+		list.PushBack(v)
+	}
+
+	//Cut the last two element off
+	tail := list.PartitionList(2, false)
+	if tail == nil || tail.Len() != 2 || list.Len() != 3 {
+		t.Fatal("Partition list Error")
+	}
+
+	if !equalInts(listValues(list), []int{1, 2, 3}) || !equalInts(listValues(tail), []int{4, 5}) {
+		t.Error("The value is not equal expected", listValues(list), listValues(tail))
+	}
+
+	//Both halves stay usable
+	list.PushBack(6)
+	tail.PushFront(0)
+	if !equalInts(listValues(list), []int{1, 2, 3, 6}) || !equalInts(listValues(tail), []int{0, 4, 5}) {
+		t.Error("The value is not equal expected", listValues(list), listValues(tail))
+	}
+
+	t.Log("TestListPartitionTyped: End Testing")
+}
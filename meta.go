@@ -0,0 +1,61 @@
+package srv
+
+import (
+	"net"
+	"time"
+)
+
+//What the pool knows of a checked out resource
+type ResourceInfo struct {
+	//the endpoint it was created by
+	Endpoint string
+	//when it was created
+	Created time.Time
+	//how many times it was checked out, this time included
+	Uses int
+	//attached by SetMeta
+	Meta any
+}
+
+//Info of the resource taken by Get, false if not taken by Get or of a type
+//the pool cannot track, see checkOut
+func (p *Pool[K, R]) Info(r R) (info ResourceInfo, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pe := p.busyElement(r)
+	if pe == nil {
+		return info, false
+	}
+
+	return ResourceInfo{
+		Endpoint: pe.ep.name,
+		Created:  pe.created,
+		Uses:     pe.uses,
+		Meta:     pe.meta,
+	}, true
+}
+
+//Attach the metadata to the resource taken by Get, such as the negotiated
+//protocol version. It is kept across Put and Get and shown to the eviction
+//policy, false if the resource was not taken by Get
+func (p *Pool[K, R]) SetMeta(r R, meta any) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pe := p.busyElement(r)
+	if pe == nil {
+		return false
+	}
+
+	pe.meta = meta
+	return true
+}
+
+//Info of the connection taken by Get, false if not taken by Get
+func (p *ConnMap) Info(c net.Conn) (ResourceInfo, bool) {
+	return p.pool.Info(c)
+}
+
+//Attach the metadata to the connection taken by Get, see Pool.SetMeta
+func (p *ConnMap) SetMeta(c net.Conn, meta any) bool {
+	return p.pool.SetMeta(c, meta)
+}
@@ -0,0 +1,187 @@
+package srv
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+//The idle monitor probes the resources idle for a whole span in the background,
+//the dead ones are closed before any Get meets them
+
+const DefaultProbeSpan = 30   //Second
+const DefaultProbeTimeout = 1 //Second
+
+//Check whether the idle resource of the key is still usable, an error means dead
+type Probe[K comparable, R io.Closer] func(ctx context.Context, key K, r R) error
+
+//What the idle monitor found of a key
+type IdleHealth struct {
+	//idle resources probed
+	Probed uint64
+	//probed ones found dead and closed
+	Dead uint64
+	//when the key was last probed
+	LastProbe time.Time
+	//the error of the last dead one
+	LastErr error
+}
+
+//Probe the resources idle for the span in the background, nil to stop probing
+func (p *Pool[K, R]) SetIdleProbe(probe Probe[K, R], span time.Duration) {
+	if span <= 0 {
+		span = DefaultProbeSpan * time.Second
+	}
+
+	p.lock.Lock()
+	p.probe = probe
+	p.probeSpan = span
+	if p.isAvaliable && p.probe != nil && !p.probeDeamonRunning {
+		p.probeChan = make(chan bool, 1)
+		go p.probeDaemon(p.probeChan)
+		p.probeDeamonRunning = true
+	}
+	p.lock.Unlock()
+}
+
+//What the idle monitor found of the key
+func (p *Pool[K, R]) IdleHealth(key K) IdleHealth {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return IdleHealth{}
+	}
+	return kp.health
+}
+
+//Probe daemon
+func (p *Pool[K, R]) probeDaemon(probeChan chan bool) {
+	for {
+		p.lock.Lock()
+		span := p.probeSpan
+		p.lock.Unlock()
+
+		select {
+		//Channel close
+		case <-probeChan:
+			return
+		//Time out for probe
+		case <-time.After(span):
+		}
+
+		p.probeIdle()
+	}
+}
+
+//Probe the resources idle for a whole span one at a time, from the least recently
+//returned. Each is out of the lists only while probed, a living one goes back where it was
+func (p *Pool[K, R]) probeIdle() {
+	p.lock.Lock()
+	p.probePass++
+	pass := p.probePass
+	cutoff := time.Now().Add(-p.probeSpan)
+	p.lock.Unlock()
+
+	var next *PoolElement[K, R]
+	for more := true; more; {
+		next, more = p.probeOne(next, pass, cutoff)
+	}
+}
+
+//Where a resource out of a list goes back: after the element, as long as it stays idle
+type probeAnchor[K comparable, R io.Closer] struct {
+	e *Element[*PoolElement[K, R]]
+	//when the element was returned, changed once it is checked out and put back
+	returned time.Time
+}
+
+func newProbeAnchor[K comparable, R io.Closer](e *Element[*PoolElement[K, R]]) probeAnchor[K, R] {
+	a := probeAnchor[K, R]{e: e}
+	if e.Value != nil {
+		a.returned = e.Value.returned
+	}
+	return a
+}
+
+//The element to go back after, the last one not probed in the pass
+//if the anchor left the list meanwhile
+func (a probeAnchor[K, R]) at(l *List[*PoolElement[K, R]], pass uint64) *Element[*PoolElement[K, R]] {
+	if a.e == &l.root || a.e.Value.local.next != nil && a.e.Value.returned.Equal(a.returned) {
+		return a.e
+	}
+	return lastUnprobed(l, pass)
+}
+
+//The last element of the list not probed in the pass, the root if none.
+//The ones probed go back together at the tail of the list
+func lastUnprobed[K comparable, R io.Closer](l *List[*PoolElement[K, R]], pass uint64) *Element[*PoolElement[K, R]] {
+	e := l.root.prev
+	for e != &l.root && e.Value.probed == pass {
+		e = e.prev
+	}
+	return e
+}
+
+//Check whether the resource is still idle for the span and not probed in the pass
+func (pe *PoolElement[K, R]) toProbe(pass uint64, cutoff time.Time) bool {
+	return pe.local.next != nil && pe.probed != pass && pe.returned.Before(cutoff)
+}
+
+//Probe the next resource, or the least recently returned one to probe if next
+//left the lists meanwhile. Return the one to probe after it, false if none is left
+func (p *Pool[K, R]) probeOne(next *PoolElement[K, R], pass uint64, cutoff time.Time) (*PoolElement[K, R], bool) {
+	p.lock.Lock()
+	probe := p.probe
+	if probe == nil || !p.isAvaliable {
+		p.lock.Unlock()
+		return nil, false
+	}
+
+	pe := next
+	if pe == nil || !pe.toProbe(pass, cutoff) {
+		pe = lastUnprobed(p.shared, pass).Value
+	}
+	if pe == nil || !pe.toProbe(pass, cutoff) {
+		p.lock.Unlock()
+		return nil, false
+	}
+
+	kp, r := pe.SrvPool, pe.Res
+	global, local := newProbeAnchor(pe.global.prev), newProbeAnchor(pe.local.prev)
+	next = global.e.Value
+	pe.probed = pass
+	kp.remove(pe)
+	p.shared.Remove(&pe.global)
+	p.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultProbeTimeout*time.Second)
+	err := probe(ctx, kp.key, r)
+	cancel()
+
+	p.lock.Lock()
+	kp.health.Probed++
+	kp.health.LastProbe = time.Now()
+	if err != nil {
+		kp.health.Dead++
+		kp.health.LastErr = err
+		kp.discards[DiscardDead]++
+	} else if kp.isStale(pe) {
+		kp.discards[DiscardStale]++
+	}
+
+	//dead, or the key is gone or expired meanwhile
+	if err != nil || !p.isAvaliable || p.keys[kp.key] != kp || kp.isStale(pe) {
+		p.recycle(pe)
+		p.lock.Unlock()
+		r.Close()
+		return next, true
+	}
+
+	if !p.handOff(kp, pe) {
+		p.shared.insert(&pe.global, global.at(p.shared, pass))
+		kp.putAfter(pe, local.at(pe.ep.list, pass))
+	}
+	p.lock.Unlock()
+	return next, true
+}
@@ -0,0 +1,110 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolIdleProbe(t *testing.T) {
+	t.Log("TestPoolIdleProbe: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	var res []*testRes
+	for i := 0; i < 4; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		res = append(res, r)
+	}
+	for _, r := range res {
+		p.Put("a", r)
+	}
+
+	//res[1] is dead
+	dead := errors.New("reset")
+	p.SetIdleProbe(func(ctx context.Context, key string, r *testRes) error {
+		if r == res[1] {
+			return dead
+		}
+		return nil
+	}, 20*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	if !res[1].isClosed() || p.IdleLen("a") != 3 {
+		t.Error("The dead resource should be closed, idle ", p.IdleLen("a"))
+	}
+	health := p.IdleHealth("a")
+	if health.Probed < 4 || health.Dead != 1 || health.LastErr != dead || health.LastProbe.IsZero() {
+		t.Error("The health of the key is wrong ", health)
+	}
+	checkPoolLists(t, p)
+
+	//The living ones keep their order
+	p.SetIdleProbe(nil, 0)
+	for _, i := range []int{3, 2, 0} {
+		if r, _ := p.Get(context.Background(), "a"); r != res[i] || r.isClosed() {
+			t.Error("The probed resources should keep their order")
+		}
+	}
+
+	t.Log("TestPoolIdleProbe: End Testing")
+}
+
+func TestPoolIdleProbeOneAtATime(t *testing.T) {
+	t.Log("TestPoolIdleProbeOneAtATime: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	var res []*testRes
+	for i := 0; i < 4; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		res = append(res, r)
+	}
+	for _, r := range res {
+		p.Put("a", r)
+	}
+
+	//The first probe hangs like a slow ping
+	probing := make(chan *testRes, 1)
+	release := make(chan struct{})
+	var once sync.Once
+	p.SetIdleProbe(func(ctx context.Context, key string, r *testRes) error {
+		once.Do(func() {
+			probing <- r
+			<-release
+		})
+		return nil
+	}, 20*time.Millisecond)
+
+	slow := <-probing
+	if slow != res[0] {
+		t.Error("The least recently returned should be probed first")
+	}
+	if p.IdleLen("a") != 3 || p.Len() != 3 {
+		t.Error("Only the probed resource should be out of the pool, idle ", p.IdleLen("a"))
+	}
+	r, _ := p.Get(context.Background(), "a")
+	if r == slow || atomic.LoadInt32(&made) != 4 {
+		t.Error("Get should take an idle resource while another is probed")
+	}
+	p.Put("a", r)
+	close(release)
+
+	time.Sleep(50 * time.Millisecond)
+	p.SetIdleProbe(nil, 0)
+	if p.IdleLen("a") != 4 || slow.isClosed() {
+		t.Error("The probed resource should go back, idle ", p.IdleLen("a"))
+	}
+	checkPoolLists(t, p)
+
+	t.Log("TestPoolIdleProbeOneAtATime: End Testing")
+}
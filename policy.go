@@ -0,0 +1,104 @@
+package srv
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+//Which idle resource of a key the next checkout takes
+type ReusePolicy int
+
+const (
+	//Take the most recently returned, the rest stay idle and get shrunk
+	ReuseLIFO ReusePolicy = iota
+	//Take the least recently returned, spreading the load over all of them
+	ReuseFIFO
+)
+
+//The view of one idle resource given to the eviction policy
+type Candidate struct {
+	//when the resource was created
+	Created time.Time
+	//when the resource was last returned to the pool
+	Returned time.Time
+	//how many times the resource was checked out
+	Uses int
+	//attached by SetMeta
+	Meta any
+}
+
+//Choose the idle resources the shrink closes
+type EvictionPolicy interface {
+	//Return the positions in idle of the n resources to close,
+	//idle is ordered from the least to the most recently returned
+	Evict(idle []Candidate, n int) []int
+}
+
+//Evict the least recently returned, the default
+type EvictLRU struct{}
+
+//Evict the most recently returned
+type EvictLIFO struct{}
+
+//Evict the oldest created
+type EvictFIFO struct{}
+
+//Evict the least checked out, the least recently returned on tie
+type EvictLFU struct{}
+
+//Evict at random
+type EvictRandom struct{}
+
+func (EvictLRU) Evict(idle []Candidate, n int) []int {
+	pos := make([]int, 0, n)
+	for i := 0; i < n && i < len(idle); i++ {
+		pos = append(pos, i)
+	}
+	return pos
+}
+
+func (EvictLIFO) Evict(idle []Candidate, n int) []int {
+	pos := make([]int, 0, n)
+	for i := len(idle) - 1; i >= 0 && len(pos) < n; i-- {
+		pos = append(pos, i)
+	}
+	return pos
+}
+
+func (EvictFIFO) Evict(idle []Candidate, n int) []int {
+	return evictSorted(idle, n, func(a, b *Candidate) bool {
+		return a.Created.Before(b.Created)
+	})
+}
+
+func (EvictLFU) Evict(idle []Candidate, n int) []int {
+	return evictSorted(idle, n, func(a, b *Candidate) bool {
+		return a.Uses < b.Uses
+	})
+}
+
+func (EvictRandom) Evict(idle []Candidate, n int) []int {
+	pos := rand.Perm(len(idle))
+	if n < len(pos) {
+		pos = pos[:n]
+	}
+	return pos
+}
+
+//The first n positions of idle stably sorted by less
+func evictSorted(idle []Candidate, n int, less func(a, b *Candidate) bool) []int {
+	pos := make([]int, len(idle))
+	for i := range pos {
+		pos[i] = i
+	}
+
+	sort.SliceStable(pos, func(i, j int) bool {
+		return less(&idle[pos[i]], &idle[pos[j]])
+	})
+
+	if n < len(pos) {
+		pos = pos[:n]
+	}
+	return pos
+}
@@ -0,0 +1,229 @@
+package srv
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicies(t *testing.T) {
+	t.Log("TestEvictionPolicies: Start Testing")
+	now := time.Now()
+	//ordered from the least to the most recently returned
+	idle := []Candidate{
+		{Created: now.Add(-2 * time.Second), Returned: now.Add(-4 * time.Second), Uses: 5},
+		{Created: now.Add(-5 * time.Second), Returned: now.Add(-3 * time.Second), Uses: 1},
+		{Created: now.Add(-1 * time.Second), Returned: now.Add(-2 * time.Second), Uses: 3},
+		{Created: now.Add(-4 * time.Second), Returned: now.Add(-1 * time.Second), Uses: 1},
+	}
+
+	testCase := []struct {
+		policy EvictionPolicy
+		expect []int
+	}{
+		{EvictLRU{}, []int{0, 1}},
+		{EvictLIFO{}, []int{3, 2}},
+		{EvictFIFO{}, []int{1, 3}},
+		{EvictLFU{}, []int{1, 3}},
+	}
+	for _, tc := range testCase {
+		pos := tc.policy.Evict(idle, 2)
+		if !equalInts(pos, tc.expect) {
+			t.Errorf("%T evict %v, expect %v", tc.policy, pos, tc.expect)
+		}
+	}
+
+	//Random picks n distinct positions
+	pos := EvictRandom{}.Evict(idle, 3)
+	sort.Ints(pos)
+	if len(pos) != 3 || pos[0] == pos[1] || pos[1] == pos[2] || pos[0] < 0 || pos[2] >= len(idle) {
+		t.Error("Random evict error ", pos)
+	}
+
+	//Ask more than idle
+	for _, policy := range []EvictionPolicy{EvictLRU{}, EvictLIFO{}, EvictFIFO{}, EvictLFU{}, EvictRandom{}} {
+		if len(policy.Evict(idle, 10)) != len(idle) {
+			t.Errorf("%T should evict all when asked more", policy)
+		}
+	}
+
+	t.Log("TestEvictionPolicies: End Testing")
+}
+
+func TestPoolReuseFIFO(t *testing.T) {
+	t.Log("TestPoolReuseFIFO: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.SetReusePolicy(ReuseFIFO)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	var res []*testRes
+	for i := 0; i < 3; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		res = append(res, r)
+	}
+	for _, r := range res {
+		p.Put("a", r)
+	}
+
+	//Every resource is used in turn
+	for i := 0; i < 6; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		if r != res[i%3] {
+			t.Error("FIFO reuse should take the least recently returned")
+		}
+		p.Put("a", r)
+	}
+
+	//LIFO keeps taking the same one
+	p.SetReusePolicy(ReuseLIFO)
+	for i := 0; i < 3; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		if r != res[2] {
+			t.Error("LIFO reuse should take the most recently returned")
+		}
+		p.Put("a", r)
+	}
+
+	t.Log("TestPoolReuseFIFO: End Testing")
+}
+
+func TestPoolEvictLFU(t *testing.T) {
+	t.Log("TestPoolEvictLFU: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.SetEvictionPolicy(EvictLFU{})
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	p.Add("b", testFactory("b", &made))
+
+	//One hot resource of "a" returned first
+	hot, _ := p.Get(context.Background(), "a")
+	p.Put("a", hot)
+	for i := 0; i < 5; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		p.Put("a", r)
+	}
+
+	var res []*testRes
+	for i := 0; i < 11; i++ {
+		r, _ := p.Get(context.Background(), "b")
+		res = append(res, r)
+	}
+	for _, r := range res {
+		p.Put("b", r)
+	}
+
+	//Make it the least recently returned
+	p.lock.Lock()
+	pe := p.keys["a"].endpoints[0].list.Front().Value
+	p.shared.Remove(&pe.global)
+	p.shared.PushBackElement(&pe.global)
+	p.lock.Unlock()
+
+	time.Sleep(5 * DefaultShrinkSpan * time.Millisecond)
+
+	if p.Len() > p.shrinkThreshold() {
+		t.Error("The pool count should be shrunk to the threshold, current count is ", p.Len())
+	}
+	if hot.isClosed() || p.IdleLen("a") != 1 {
+		t.Error("LFU should keep the most used resource")
+	}
+	checkPoolLists(t, p)
+
+	t.Log("TestPoolEvictLFU: End Testing")
+}
+
+func TestPoolDiscard(t *testing.T) {
+	t.Log("TestPoolDiscard: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	r, _ := p.Get(context.Background(), "a")
+	p.Discard(r)
+	if !r.isClosed() || p.Len() != 0 {
+		t.Error("Discard should close the resource")
+	}
+
+	p.lock.Lock()
+	busy := len(p.busy)
+	p.lock.Unlock()
+	if busy != 0 {
+		t.Error("Discard should forget the resource, busy ", busy)
+	}
+
+	t.Log("TestPoolDiscard: End Testing")
+}
+
+//Evict the resources without metadata first
+type evictNoMeta struct{}
+
+func (evictNoMeta) Evict(idle []Candidate, n int) []int {
+	return evictSorted(idle, n, func(a, b *Candidate) bool {
+		return a.Meta == nil && b.Meta != nil
+	})
+}
+
+func TestPoolMeta(t *testing.T) {
+	t.Log("TestPoolMeta: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.SetEvictionPolicy(evictNoMeta{})
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	r, _ := p.Get(context.Background(), "a")
+	if !p.SetMeta(r, "v2") {
+		t.Fatal("Should attach metadata to the resource in use")
+	}
+	p.Put("a", r)
+	if p.SetMeta(r, "v3") {
+		t.Error("The idle resource should not take metadata")
+	}
+	if _, ok := p.Info(r); ok {
+		t.Error("The idle resource should have no info")
+	}
+
+	//Kept across Put and Get
+	r2, _ := p.Get(context.Background(), "a")
+	info, ok := p.Info(r2)
+	if r2 != r || !ok || info.Meta != "v2" || info.Uses != 2 || info.Created.IsZero() {
+		t.Error("The metadata should survive Put and Get ", info)
+	}
+
+	//Shown to the eviction policy
+	var res []*testRes
+	for i := 0; i < 10; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		res = append(res, r)
+	}
+	p.Put("a", r2)
+	for _, r := range res {
+		p.Put("a", r)
+	}
+	time.Sleep(5 * DefaultShrinkSpan * time.Millisecond)
+	if r2.isClosed() {
+		t.Error("The policy should keep the resource with metadata")
+	}
+
+	//Cleared once the element is recycled
+	p.Drain("a")
+	r3, _ := p.Get(context.Background(), "a")
+	p.SetMeta(r3, "v2")
+	p.Discard(r3)
+	r4, _ := p.Get(context.Background(), "a")
+	if info, _ := p.Info(r4); info.Meta != nil {
+		t.Error("The recycled element should not keep the metadata")
+	}
+
+	t.Log("TestPoolMeta: End Testing")
+}
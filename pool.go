@@ -0,0 +1,945 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//a map from key to resource pool, all keys share one LRU list and one capacity
+
+//Create a new resource for the key
+type Factory[R io.Closer] func(ctx context.Context) (R, error)
+
+//Resource of the pool, an idle one is linked in both the global list and its key list,
+//a checked out one is kept in the busy map until it comes back or is found closed
+type PoolElement[K comparable, R io.Closer] struct {
+	SrvPool *KeyPool[K, R]
+	Res     R
+	//the endpoint of the key it belongs to
+	ep *endpointPool[K, R]
+	//when the resource was created
+	created time.Time
+	//when the resource was last returned
+	returned time.Time
+	//how many times the resource was checked out
+	uses int
+	//generation of the key when the resource was created
+	gen uint64
+	//attached by SetMeta, kept while the resource is pooled
+	meta any
+	//the pass of the idle monitor it was last probed in
+	probed uint64
+	//links of the global LRU list
+	global Element[*PoolElement[K, R]]
+	//links of the key list
+	local Element[*PoolElement[K, R]]
+}
+
+func newPoolElement[K comparable, R io.Closer]() *PoolElement[K, R] {
+	pe := new(PoolElement[K, R])
+	pe.global.Value = pe
+	pe.local.Value = pe
+	return pe
+}
+
+type Pool[K comparable, R io.Closer] struct {
+	//guards every field below, the key lists included
+	lock   sync.Mutex
+	keys   map[K]*KeyPool[K, R]
+	shared *List[*PoolElement[K, R]]
+	//checked out resources, so their element survives the borrow
+	busy map[any]*PoolElement[K, R]
+	//tell the checked out resources closed without Put or Discard, nil if not checked
+	closedCheck     func(r R) bool
+	lastClosedCheck time.Time
+	//pool elements kept for reuse
+	free []*PoolElement[K, R]
+	//which idle resource Get takes and which ones the shrink closes
+	reuse ReusePolicy
+	evict EvictionPolicy
+	//keys expired since the last shrink tick
+	expired map[K]bool
+	//scratch space of the shrink
+	candidates []Candidate
+	victims    []*PoolElement[K, R]
+	//capacity
+	capacity int
+	//is avaliable
+	isAvaliable bool
+	//shrink deamon
+	shrinkDeamonRunning bool
+	//channel for notified the deamon
+	shrinkChan chan bool
+	//what the shrink did so far
+	shrinkStats ShrinkStats
+	//probe of the idle resources, nil if not probed
+	probe     Probe[K, R]
+	probeSpan time.Duration
+	//counts the probe passes, so a pass tells the resources it probed
+	probePass uint64
+	//probe deamon
+	probeDeamonRunning bool
+	probeChan          chan bool
+}
+
+func NewPool[K comparable, R io.Closer](capx int) *Pool[K, R] {
+	if capx > DefaultMaxConnections {
+		capx = DefaultMaxConnections
+	}
+
+	return &Pool[K, R]{
+		keys:        make(map[K]*KeyPool[K, R]),
+		shared:      NewList[*PoolElement[K, R]](),
+		busy:        make(map[any]*PoolElement[K, R]),
+		expired:     make(map[K]bool),
+		evict:       EvictLRU{},
+		capacity:    capx,
+		isAvaliable: false,
+	}
+}
+
+//New pool element holding r, a recycled one if any,
+//the caller must hold the lock
+func (p *Pool[K, R]) newElement(kp *KeyPool[K, R], r R) *PoolElement[K, R] {
+	var pe *PoolElement[K, R]
+	if n := len(p.free); n > 0 {
+		pe = p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+	} else {
+		pe = newPoolElement[K, R]()
+	}
+
+	pe.SrvPool = kp
+	pe.Res = r
+	return pe
+}
+
+//Recycle the pool element taken out of the lists,
+//the caller must hold the lock
+func (p *Pool[K, R]) recycle(pe *PoolElement[K, R]) {
+	if len(p.free) >= p.capacity {
+		return
+	}
+
+	var zero R
+	pe.SrvPool = nil
+	pe.ep = nil
+	pe.Res = zero
+	pe.created = time.Time{}
+	pe.returned = time.Time{}
+	pe.uses = 0
+	pe.gen = 0
+	pe.meta = nil
+	pe.probed = 0
+	p.free = append(p.free, pe)
+}
+
+//Set which idle resource Get takes
+func (p *Pool[K, R]) SetReusePolicy(reuse ReusePolicy) {
+	p.lock.Lock()
+	p.reuse = reuse
+	p.lock.Unlock()
+}
+
+//Set which idle resources the shrink closes, nil for EvictLRU
+func (p *Pool[K, R]) SetEvictionPolicy(evict EvictionPolicy) {
+	if evict == nil {
+		evict = EvictLRU{}
+	}
+
+	p.lock.Lock()
+	p.evict = evict
+	p.lock.Unlock()
+}
+
+func (p *Pool[K, R]) Start() {
+	p.lock.Lock()
+	p.isAvaliable = true
+
+	if p.shrinkDeamonRunning == false {
+		p.shrinkChan = make(chan bool, 1)
+		go p.shrinkDaemon(p.shrinkChan)
+		p.shrinkDeamonRunning = true
+	}
+
+	if p.probe != nil && p.probeDeamonRunning == false {
+		p.probeChan = make(chan bool, 1)
+		go p.probeDaemon(p.probeChan)
+		p.probeDeamonRunning = true
+	}
+
+	p.lock.Unlock()
+}
+
+//Check whether the pool is started and not closed
+func (p *Pool[K, R]) IsAvaliable() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.isAvaliable
+}
+
+//Idle resource count of the whole pool
+func (p *Pool[K, R]) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.shared.Len()
+}
+
+//Idle resource count of the key
+func (p *Pool[K, R]) IdleLen(key K) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return 0
+	}
+	return kp.getIdleCnt()
+}
+
+//Get an idle resource of the key or create a new one, the resource must be
+//given back by Put or Discard unless SetClosedCheck tells it was closed
+func (p *Pool[K, R]) Get(ctx context.Context, key K) (r R, err error) {
+	r, hit, kp, w, stale, err := p.takeIdle(key)
+	closeAllRes(stale)
+	if err != nil || hit {
+		return
+	}
+	return p.dial(ctx, kp, w)
+}
+
+//Take an idle resource of the key, hit is false on a miss with the dial slot
+//taken or the queued w returned to wait for one. The stale ones met on the way
+//are returned to be closed without the lock
+func (p *Pool[K, R]) takeIdle(key K) (r R, hit bool, kp *KeyPool[K, R], w *dialWaiter[K, R], stale []R, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.isAvaliable {
+		err = errors.New(ERROR_CONNPOOL_UNAVALIABLE)
+		return
+	}
+
+	kp = p.keys[key]
+	if kp == nil {
+		err = errors.New(ERROR_NO_EXIST_SERVER)
+		return
+	}
+
+	pe := kp.get(p.reuse)
+	//Close the stale ones on the way
+	for pe != nil && kp.isStale(pe) {
+		kp.discards[DiscardStale]++
+		p.shared.Remove(&pe.global)
+		stale = append(stale, pe.Res)
+		p.recycle(pe)
+		pe = kp.get(p.reuse)
+	}
+
+	if pe == nil {
+		//Take a dial slot or queue up before the lock is released,
+		//so a resource put back meanwhile reaches this Get
+		if kp.dialSlotFree() {
+			kp.dialing++
+		} else {
+			w = kp.pushWaiter()
+		}
+		return
+	}
+
+	p.shared.Remove(&pe.global)
+	r = pe.Res
+	p.checkOut(pe)
+	return r, true, kp, nil, stale, nil
+}
+
+//Create a new resource of the key on a miss with the dial slot taken,
+//or wait as the queued w for a resource put back or a dial slot
+func (p *Pool[K, R]) dial(ctx context.Context, kp *KeyPool[K, R], w *dialWaiter[K, R]) (r R, err error) {
+	p.lock.Lock()
+	if w != nil {
+		var dial bool
+		if r, dial, err = p.waitTurn(ctx, kp, w); !dial {
+			p.lock.Unlock()
+			return
+		}
+	}
+
+	ep := kp.nextEndpoint()
+	if ep == nil {
+		p.releaseDial(kp)
+		p.lock.Unlock()
+		err = errors.New(ERROR_NO_ENDPOINT)
+		return
+	}
+
+	var change stateChange
+	if kp.breaker != nil {
+		var ok bool
+		if ok, change = kp.breaker.allow(time.Now()); !ok {
+			p.releaseDial(kp)
+			p.lock.Unlock()
+			err = errors.New(ERROR_CIRCUIT_OPEN)
+			return
+		}
+	}
+
+	factory, retry := ep.factory, kp.retry
+	gen := kp.gen
+	ep.busy++
+	kp.inUse++
+	p.lock.Unlock()
+	change.fire()
+	change = stateChange{}
+	//new one resource
+	r, err = dialRetry(ctx, factory, retry)
+	p.dialDone(ctx, kp, ep, gen, r, err).fire()
+	return
+}
+
+//Release the dial slot and the endpoint counted busy by dial,
+//a dialed resource is checked out
+func (p *Pool[K, R]) dialDone(ctx context.Context, kp *KeyPool[K, R], ep *endpointPool[K, R], gen uint64, r R, err error) (change stateChange) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.releaseDial(kp)
+	ep.busy--
+	kp.inUse--
+	if err != nil {
+		kp.recordDialError(ep.name, err)
+		if kp.breaker != nil {
+			if ctx.Err() != nil {
+				kp.breaker.release()
+			} else {
+				change = kp.breaker.failure(time.Now())
+			}
+		}
+		return
+	}
+
+	if kp.breaker != nil {
+		change = kp.breaker.success()
+	}
+	pe := p.newElement(kp, r)
+	pe.ep = ep
+	pe.created = time.Now()
+	//an Expire during the dial makes it stale
+	pe.gen = gen
+	p.checkOut(pe)
+	return
+}
+
+//Put resource to the specified key pool
+func (p *Pool[K, R]) Put(key K, r R) {
+	if !p.putIdle(key, r) {
+		r.Close()
+	}
+}
+
+//Pool the resource put back, false if it is to be closed instead
+func (p *Pool[K, R]) putIdle(key K, r R) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pe := p.checkIn(r)
+
+	kp := p.keys[key]
+	if !p.isAvaliable || kp == nil {
+		if pe != nil {
+			p.recycle(pe)
+		}
+		return false
+	}
+
+	//Not from Get or from another key
+	if pe == nil || pe.SrvPool != kp {
+		ep := kp.defaultEndpoint()
+		if ep == nil {
+			if pe != nil {
+				p.recycle(pe)
+			}
+			return false
+		}
+
+		if pe == nil {
+			pe = p.newElement(kp, r)
+			pe.created = time.Now()
+		}
+		pe.SrvPool = kp
+		pe.ep = ep
+		pe.gen = kp.gen
+	} else if kp.isStale(pe) {
+		//Created before the last Expire
+		kp.discards[DiscardStale]++
+		p.recycle(pe)
+		return false
+	} else if kp.isRetired(pe) {
+		kp.discards[DiscardRetired]++
+		p.recycle(pe)
+		return false
+	}
+
+	pe.returned = time.Now()
+	//A Get waits for it
+	if p.handOff(kp, pe) {
+		return true
+	}
+
+	p.shared.PushFrontElement(&pe.global)
+	kp.put(pe)
+
+	//Whether need to shrink
+	if p.shared.Len() > p.shrinkThreshold() {
+		select {
+		//Send shrink signal
+		case p.shrinkChan <- true:
+		//signal already pending or no deamon running
+		default:
+		}
+	}
+	return true
+}
+
+//Whether the resource can be kept in the busy map, the value of a type not
+//comparable such as a struct holding a slice cannot be a map key
+func trackable(r any) bool {
+	t := reflect.TypeOf(r)
+	if t == nil || !t.Comparable() {
+		return false
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Array:
+		//an interface field may hold a value not comparable
+		return reflect.ValueOf(r).Comparable()
+	}
+	return true
+}
+
+//Count the resource checked out and keep it in the busy map. One not trackable
+//is checked out untracked, its element is dropped and Put takes it as a new one.
+//The caller must hold the lock
+func (p *Pool[K, R]) checkOut(pe *PoolElement[K, R]) {
+	pe.uses++
+	if !trackable(pe.Res) {
+		return
+	}
+
+	pe.ep.busy++
+	pe.SrvPool.inUse++
+	p.busy[pe.Res] = pe
+}
+
+//Element of the checked out resource, nil if not taken by Get or not tracked.
+//The caller must hold the lock
+func (p *Pool[K, R]) busyElement(r R) *PoolElement[K, R] {
+	if !trackable(r) {
+		return nil
+	}
+	return p.busy[r]
+}
+
+//Take the resource off the checked out ones, nil if not taken by Get.
+//The caller must hold the lock
+func (p *Pool[K, R]) checkIn(r R) *PoolElement[K, R] {
+	pe := p.busyElement(r)
+	if pe != nil {
+		delete(p.busy, r)
+		pe.ep.busy--
+		pe.SrvPool.inUse--
+	}
+	return pe
+}
+
+//Tell the checked out resources closed without Put or Discard, such as by the caller
+//after an I/O error. Their checkout is released in the background, counted as
+//DiscardCaller, nil to stop checking
+func (p *Pool[K, R]) SetClosedCheck(closed func(r R) bool) {
+	p.lock.Lock()
+	p.closedCheck = closed
+	p.lock.Unlock()
+}
+
+//Release the checkouts of the resources found closed
+func (p *Pool[K, R]) releaseClosed() {
+	p.lock.Lock()
+	closed := p.closedCheck
+	p.lastClosedCheck = time.Now()
+	if closed == nil || len(p.busy) == 0 {
+		p.lock.Unlock()
+		return
+	}
+
+	res := make([]R, 0, len(p.busy))
+	for _, pe := range p.busy {
+		res = append(res, pe.Res)
+	}
+	p.lock.Unlock()
+
+	//check them without the lock
+	n := 0
+	for _, r := range res {
+		if closed(r) {
+			res[n] = r
+			n++
+		}
+	}
+	if n == 0 {
+		return
+	}
+
+	p.releaseCheckouts(res[:n], DiscardCaller)
+}
+
+//Release the checkouts of the resources closed outside the pool, counted for the reason
+func (p *Pool[K, R]) releaseCheckouts(res []R, reason DiscardReason) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, r := range res {
+		if pe := p.checkIn(r); pe != nil {
+			pe.SrvPool.discards[reason]++
+			p.recycle(pe)
+		}
+	}
+}
+
+//Mark the resources of the key created so far as stale. The idle ones are
+//closed by the next Get or shrink tick, the checked out ones when put back
+func (p *Pool[K, R]) Expire(key K) {
+	p.lock.Lock()
+	if kp := p.keys[key]; kp != nil {
+		kp.gen++
+		p.expired[key] = true
+	}
+	p.lock.Unlock()
+}
+
+//Close the resource taken by Get instead of putting it back
+func (p *Pool[K, R]) Discard(r R) {
+	p.discard(r, DiscardCaller)
+}
+
+//Add the key with the factory creating its resources
+func (p *Pool[K, R]) Add(key K, factory Factory[R]) error {
+	return p.AddEndpoints(key, []Endpoint[R]{{Factory: factory}})
+}
+
+//Add the key with its endpoints, new resources are created by each endpoint in turn
+func (p *Pool[K, R]) AddEndpoints(key K, eps []Endpoint[R]) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.isAvaliable {
+		return errors.New(ERROR_CONNPOOL_UNAVALIABLE)
+	}
+
+	if p.keys[key] != nil {
+		return errors.New(ERROR_CONFLICT_SERVER_INFO)
+	}
+
+	p.keys[key] = newKeyPool(key, eps)
+	return nil
+}
+
+//Set how the key chooses the endpoint new resources are created by, nil for BalanceRoundRobin
+func (p *Pool[K, R]) SetBalancer(key K, balancer Balancer) error {
+	if balancer == nil {
+		balancer = BalanceRoundRobin{}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return errors.New(ERROR_NO_EXIST_SERVER)
+	}
+
+	kp.balancer = balancer
+	return nil
+}
+
+//Set the circuit breaker of the key, nil to disable it
+func (p *Pool[K, R]) SetBreaker(key K, config *BreakerConfig) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return errors.New(ERROR_NO_EXIST_SERVER)
+	}
+
+	kp.breaker = nil
+	if config != nil {
+		kp.breaker = newBreaker(*config)
+	}
+	return nil
+}
+
+//Set how the failed dials of the key are retried, nil to disable the retry
+func (p *Pool[K, R]) SetRetryPolicy(key K, rp *RetryPolicy) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return errors.New(ERROR_NO_EXIST_SERVER)
+	}
+
+	kp.retry = nil
+	if rp != nil {
+		retry := *rp
+		kp.retry = &retry
+	}
+	return nil
+}
+
+//Close the resources of the key on Put once checked out n times, 0 for no limit
+func (p *Pool[K, R]) SetMaxUses(key K, n int) error {
+	if n < 0 {
+		n = 0
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return errors.New(ERROR_NO_EXIST_SERVER)
+	}
+
+	kp.maxUses = n
+	return nil
+}
+
+//Circuit state of the key, closed if the key has no breaker
+func (p *Pool[K, R]) CircuitState(key K) CircuitState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil || kp.breaker == nil {
+		return CircuitClosed
+	}
+	return kp.breaker.state
+}
+
+//Replace the endpoints of the key. The endpoints keeping their name keep their idle
+//resources, the idle ones of the removed endpoints are closed in the background,
+//the ones in use when put back
+func (p *Pool[K, R]) SetEndpoints(key K, eps []Endpoint[R]) error {
+	p.lock.Lock()
+	kp := p.keys[key]
+	if kp == nil {
+		p.lock.Unlock()
+		return errors.New(ERROR_NO_EXIST_SERVER)
+	}
+
+	clearList := NewList[*PoolElement[K, R]]()
+	for _, ep := range kp.setEndpoints(eps) {
+		for ep.list.Len() > 0 {
+			pe := ep.list.Front().Value
+			kp.discards[DiscardStale]++
+			kp.remove(pe)
+			p.shared.Remove(&pe.global)
+			clearList.PushBackElement(&pe.global)
+		}
+	}
+	p.lock.Unlock()
+
+	go p.closeAll(clearList)
+	return nil
+}
+
+//Names of the endpoints of the key
+func (p *Pool[K, R]) Endpoints(key K) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(kp.endpoints))
+	for _, ep := range kp.endpoints {
+		names = append(names, ep.name)
+	}
+	return names
+}
+
+//Del the key and close its idle resources
+func (p *Pool[K, R]) Del(key K) {
+	p.lock.Lock()
+	kp := p.keys[key]
+	if !p.isAvaliable || kp == nil {
+		p.lock.Unlock()
+		return
+	}
+
+	delete(p.keys, key)
+	clearList := p.detachKeyPool(kp)
+	p.failWaiters(kp, errors.New(ERROR_NO_EXIST_SERVER))
+	p.lock.Unlock()
+
+	go p.closeAll(clearList)
+}
+
+//Close the idle resources of the key in the background and keep the key
+func (p *Pool[K, R]) Drain(key K) {
+	p.lock.Lock()
+	kp := p.keys[key]
+	if kp == nil {
+		p.lock.Unlock()
+		return
+	}
+
+	clearList := p.detachKeyPool(kp)
+	p.lock.Unlock()
+
+	go p.closeAll(clearList)
+}
+
+//The idle resource count the shrink daemon keeps the pool under
+func (p *Pool[K, R]) shrinkThreshold() int {
+	return int(float64(p.capacity) * DefaultConnectionThresholdRate)
+}
+
+//Shrink the pool and return the last pos should be split,
+//the caller must hold the lock
+func (p *Pool[K, R]) findShrinkPos(needShrinkCnt int) (lastpos *Element[*PoolElement[K, R]], actualpos int) {
+	if p.shared.Len() == 0 || needShrinkCnt > p.shared.Len() {
+		return
+	}
+
+	//The Zero position
+	lastpos = p.shared.Front().prev
+	actualpos = 0
+	for ; actualpos < needShrinkCnt && p.shared.Len() > 0; actualpos++ {
+		lastpos = lastpos.prev
+		if lastpos == nil {
+			break
+		}
+
+		if lastpos.Value == nil {
+			continue
+		}
+
+		//Remove it from the key pool list wherever it is
+		pe := lastpos.Value
+		pe.SrvPool.remove(pe)
+	}
+
+	return lastpos, actualpos
+}
+
+//Shrink daemon for shrink the pool
+func (p *Pool[K, R]) shrinkDaemon(shrinkChan chan bool) {
+	for {
+		select {
+		//Receive shrink signal
+		case _, ok := <-shrinkChan:
+			//Channel close
+			if !ok {
+				return
+			}
+		//Time out for shrink
+		case <-time.After(DefaultShrinkSpan * time.Millisecond):
+		}
+
+		p.shrink()
+
+		p.lock.Lock()
+		checkClosed := time.Since(p.lastClosedCheck) >= DefaultClosedCheckSpan*time.Second
+		p.lock.Unlock()
+		if checkClosed {
+			p.releaseClosed()
+		}
+	}
+}
+
+//Close resources in the list
+func (p *Pool[K, R]) closeAll(clearList *List[*PoolElement[K, R]]) {
+	for clearList.Len() > 0 {
+		pe := clearList.PopFront()
+		if pe != nil {
+			pe.Res.Close()
+		}
+	}
+}
+
+//Close resources taken out of the lists
+func closeAllRes[R io.Closer](res []R) {
+	for _, r := range res {
+		r.Close()
+	}
+}
+
+//Shrink the global resource pool
+func (p *Pool[K, R]) shrink() {
+	p.lock.Lock()
+	if !p.isAvaliable {
+		p.lock.Unlock()
+		return
+	}
+
+	//Take out the stale ones of the expired keys first
+	staleList := p.sweepExpired()
+
+	//Shrink to threshold
+	clearList := p.takeShrink(p.shared.Len() - p.shrinkThreshold())
+	p.recordShrink(clearList)
+	p.lock.Unlock()
+
+	//Close all resource already shrink
+	if staleList != nil && staleList.Len() > 0 {
+		go p.closeAll(staleList)
+	}
+	if clearList != nil && clearList.Len() > 0 {
+		go p.closeAll(clearList)
+	}
+}
+
+//Take the idle resources to close out of both lists, chosen by the eviction policy.
+//Return nil if none, the caller must hold the lock
+func (p *Pool[K, R]) takeShrink(needShrinkCnt int) *List[*PoolElement[K, R]] {
+	if needShrinkCnt <= 0 {
+		return nil
+	}
+
+	if _, isLRU := p.evict.(EvictLRU); !isLRU {
+		return p.evictByPolicy(needShrinkCnt)
+	}
+
+	//Reverse traversal the global LRU list
+	//and mark the position should be cut off in the key pool
+	lastpos, actual := p.findShrinkPos(needShrinkCnt)
+	if lastpos == nil || actual == 0 {
+		return nil
+	}
+
+	//Cut off the lru list
+	return p.shared.PartitionListQuick(lastpos, actual, false)
+}
+
+//Take the stale resources of the expired keys out of both lists,
+//the caller must hold the lock
+func (p *Pool[K, R]) sweepExpired() *List[*PoolElement[K, R]] {
+	if len(p.expired) == 0 {
+		return nil
+	}
+
+	staleList := NewList[*PoolElement[K, R]]()
+	for key := range p.expired {
+		delete(p.expired, key)
+		kp := p.keys[key]
+		if kp == nil {
+			continue
+		}
+
+		for _, ep := range kp.endpoints {
+			ep.list.Range(func(pe *PoolElement[K, R]) bool {
+				if kp.isStale(pe) {
+					kp.discards[DiscardStale]++
+					kp.remove(pe)
+					p.shared.Remove(&pe.global)
+					staleList.PushBackElement(&pe.global)
+				}
+				return true
+			})
+		}
+	}
+
+	return staleList
+}
+
+//Take the resources chosen by the eviction policy out of both lists,
+//the caller must hold the lock
+func (p *Pool[K, R]) evictByPolicy(needShrinkCnt int) *List[*PoolElement[K, R]] {
+	p.candidates = p.candidates[:0]
+	p.victims = p.victims[:0]
+	for e := p.shared.Back(); e != nil && e != &p.shared.root; e = e.prev {
+		pe := e.Value
+		p.candidates = append(p.candidates, Candidate{
+			Created:  pe.created,
+			Returned: pe.returned,
+			Uses:     pe.uses,
+			Meta:     pe.meta,
+		})
+		p.victims = append(p.victims, pe)
+	}
+
+	clearList := NewList[*PoolElement[K, R]]()
+	for _, pos := range p.evict.Evict(p.candidates, needShrinkCnt) {
+		if pos < 0 || pos >= len(p.victims) || p.victims[pos] == nil {
+			continue
+		}
+
+		pe := p.victims[pos]
+		p.victims[pos] = nil
+		pe.SrvPool.remove(pe)
+		p.shared.Remove(&pe.global)
+		clearList.PushBackElement(&pe.global)
+	}
+
+	//Drop the references to the resources
+	for i := range p.victims {
+		p.victims[i] = nil
+	}
+
+	return clearList
+}
+
+//Take all idle resource of the key pool out of the global LRU list,
+//the caller must hold the lock
+func (p *Pool[K, R]) detachKeyPool(kp *KeyPool[K, R]) *List[*PoolElement[K, R]] {
+	clearList := NewList[*PoolElement[K, R]]()
+	for pe := kp.get(ReuseLIFO); pe != nil; pe = kp.get(ReuseLIFO) {
+		p.shared.Remove(&pe.global)
+		clearList.PushBackElement(&pe.global)
+	}
+
+	return clearList
+}
+
+//Close whole pool, the keys are removed
+func (p *Pool[K, R]) Close() {
+	p.lock.Lock()
+
+	//unavaliable
+	p.isAvaliable = false
+
+	for key, kp := range p.keys {
+		delete(p.keys, key)
+		p.failWaiters(kp, errors.New(ERROR_CONNPOOL_UNAVALIABLE))
+		//its elements go away with the global list below
+		for _, ep := range kp.endpoints {
+			ep.list.Init()
+		}
+		kp.idle = 0
+	}
+	for key := range p.expired {
+		delete(p.expired, key)
+	}
+
+	if p.shared.Len() > 0 {
+		//clear all resource
+		cleanLru := p.shared.PartitionListQuick(p.shared.Front(), 0, true)
+		go p.closeAll(cleanLru)
+	}
+
+	p.lock.Unlock()
+}
+
+//Close all resource and stop the shrink daemon
+func (p *Pool[K, R]) ShutDown() {
+	p.Close()
+
+	p.lock.Lock()
+	if p.shrinkDeamonRunning {
+		close(p.shrinkChan)
+		p.shrinkChan = nil
+		p.shrinkDeamonRunning = false
+	}
+	if p.probeDeamonRunning {
+		close(p.probeChan)
+		p.probeChan = nil
+		p.probeDeamonRunning = false
+	}
+	p.lock.Unlock()
+}
@@ -0,0 +1,557 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//Resource for testing the generic pool
+type testRes struct {
+	key    string
+	closed int32
+}
+
+func (r *testRes) Close() error {
+	atomic.AddInt32(&r.closed, 1)
+	return nil
+}
+
+func (r *testRes) isClosed() bool {
+	return atomic.LoadInt32(&r.closed) > 0
+}
+
+//Factory counting the resources it made
+func testFactory(key string, made *int32) Factory[*testRes] {
+	return func(ctx context.Context) (*testRes, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		atomic.AddInt32(made, 1)
+		return &testRes{key: key}, nil
+	}
+}
+
+func TestPoolGetPut(t *testing.T) {
+	t.Log("TestPoolGetPut: Start Testing")
+	p := NewPool[string, *testRes](10)
+
+	//Not started
+	if _, err := p.Get(context.Background(), "a"); err == nil || err.Error() != ERROR_CONNPOOL_UNAVALIABLE {
+		t.Error("Get should be unavaliable before start")
+	}
+
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	if err := p.Add("a", testFactory("a", &made)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("a", testFactory("a", &made)); err == nil || err.Error() != ERROR_CONFLICT_SERVER_INFO {
+		t.Error("Add the same key should conflict")
+	}
+
+	if _, err := p.Get(context.Background(), "b"); err == nil || err.Error() != ERROR_NO_EXIST_SERVER {
+		t.Error("The key should add first")
+	}
+
+	//Factory error is returned as is
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Get(ctx, "a"); !errors.Is(err, context.Canceled) {
+		t.Error("The factory error should be returned, got ", err)
+	}
+
+	r1, err := p.Get(context.Background(), "a")
+	if err != nil || r1 == nil || atomic.LoadInt32(&made) != 1 {
+		t.Fatal("Should create a resource with the factory", err)
+	}
+
+	p.Put("a", r1)
+	if p.IdleLen("a") != 1 || p.Len() != 1 {
+		t.Error("Put error happend")
+	}
+
+	r2, err := p.Get(context.Background(), "a")
+	if err != nil || r2 != r1 || atomic.LoadInt32(&made) != 1 {
+		t.Error("Should reuse the idle resource")
+	}
+
+	//Put to unknown key closes the resource
+	p.Put("b", r2)
+	if !r2.isClosed() {
+		t.Error("Resource of unknown key should be closed")
+	}
+
+	t.Log("TestPoolGetPut: End Testing")
+}
+
+//Resource of a type not comparable, the pool cannot key it by value
+type sliceRes struct {
+	closed *int32
+	buf    []byte
+}
+
+func (r sliceRes) Close() error {
+	atomic.AddInt32(r.closed, 1)
+	return nil
+}
+
+func TestPoolUntracked(t *testing.T) {
+	t.Log("TestPoolUntracked: Start Testing")
+	p := NewPool[string, io.Closer](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made, closed int32
+	p.Add("a", func(ctx context.Context) (io.Closer, error) {
+		atomic.AddInt32(&made, 1)
+		return sliceRes{closed: &closed, buf: make([]byte, 1)}, nil
+	})
+
+	r, err := p.Get(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Info(r); ok {
+		t.Error("The resource not comparable should not be tracked")
+	}
+	if s, _ := p.Stats("a"); s.InUse != 0 {
+		t.Error("The resource not comparable should not be counted in use, in use ", s.InUse)
+	}
+
+	p.Put("a", r)
+	if p.IdleLen("a") != 1 {
+		t.Error("The resource not comparable should be pooled")
+	}
+	if r, err = p.Get(context.Background(), "a"); err != nil || atomic.LoadInt32(&made) != 1 {
+		t.Error("The idle resource should be reused", err)
+	}
+	p.Discard(r)
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Error("The discarded resource should be closed")
+	}
+
+	//the lock is not left held
+	r, err = p.Get(context.Background(), "a")
+	p.Put("a", r)
+	if err != nil || p.IdleLen("a") != 1 {
+		t.Error("The pool should stay usable", err)
+	}
+
+	t.Log("TestPoolUntracked: End Testing")
+}
+
+func TestPoolShrink(t *testing.T) {
+	t.Log("TestPoolShrink: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	p.Add("b", testFactory("b", &made))
+
+	var res []*testRes
+	for i := 0; i < 20; i++ {
+		key := "a"
+		if i%2 == 1 {
+			key = "b"
+		}
+		r, _ := p.Get(context.Background(), key)
+		res = append(res, r)
+	}
+	for _, r := range res {
+		p.Put(r.key, r)
+	}
+
+	time.Sleep(5 * DefaultShrinkSpan * time.Millisecond)
+
+	if p.Len() > p.shrinkThreshold() {
+		t.Error("The pool count should be shrunk to the threshold, current count is ", p.Len())
+	}
+	if p.IdleLen("a")+p.IdleLen("b") != p.Len() {
+		t.Error("The key pools should be shrunk with the global list")
+	}
+
+	//The least recently returned are closed first
+	closed := 0
+	for i, r := range res {
+		if r.isClosed() {
+			closed++
+			if i >= len(res)-p.shrinkThreshold() {
+				t.Error("Recently returned resource should not be closed")
+			}
+		}
+	}
+	if closed != len(res)-p.Len() {
+		t.Error("The shrunk resources should be closed, closed ", closed)
+	}
+
+	t.Log("TestPoolShrink: End Testing")
+}
+
+func TestPoolDelAndDrain(t *testing.T) {
+	t.Log("TestPoolDelAndDrain: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	p.Add("b", testFactory("b", &made))
+
+	ra, _ := p.Get(context.Background(), "a")
+	rb, _ := p.Get(context.Background(), "b")
+	p.Put("a", ra)
+	p.Put("b", rb)
+
+	p.Drain("a")
+	time.Sleep(10 * time.Millisecond)
+	if !ra.isClosed() || p.IdleLen("a") != 0 || p.Len() != 1 {
+		t.Error("Drain should close the idle resources of the key")
+	}
+	if _, err := p.Get(context.Background(), "a"); err != nil {
+		t.Error("Drain should keep the key")
+	}
+
+	p.Del("b")
+	time.Sleep(10 * time.Millisecond)
+	if !rb.isClosed() || p.Len() != 0 {
+		t.Error("Del should close the idle resources of the key")
+	}
+	if _, err := p.Get(context.Background(), "b"); err == nil || err.Error() != ERROR_NO_EXIST_SERVER {
+		t.Error("Del should remove the key")
+	}
+
+	t.Log("TestPoolDelAndDrain: End Testing")
+}
+
+func TestPoolGetPutAllocs(t *testing.T) {
+	t.Log("TestPoolGetPutAllocs: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	r, _ := p.Get(context.Background(), "a")
+	p.Put("a", r)
+
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(1000, func() {
+		r, err := p.Get(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Put("a", r)
+	})
+	if allocs != 0 {
+		t.Error("Steady state Get/Put should not allocate, allocs ", allocs)
+	}
+	if atomic.LoadInt32(&made) != 1 {
+		t.Error("Should reuse the idle resource")
+	}
+
+	t.Log("TestPoolGetPutAllocs: End Testing")
+}
+
+//Check every idle element is linked in both lists, the caller holds no lock
+func checkPoolLists[K comparable, R io.Closer](t *testing.T, p *Pool[K, R]) {
+	t.Helper()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	inShared := map[*PoolElement[K, R]]bool{}
+	p.shared.Do(func(pe *PoolElement[K, R]) {
+		inShared[pe] = true
+	})
+
+	keyCnt := 0
+	for key, kp := range p.keys {
+		idle := 0
+		for _, ep := range kp.endpoints {
+			ep.list.Do(func(pe *PoolElement[K, R]) {
+				idle++
+				if pe.SrvPool != kp || pe.ep != ep {
+					t.Error("Element linked in the wrong key list ", key)
+				}
+				if !inShared[pe] {
+					t.Error("Element in key list but not in the global list ", key)
+				}
+			})
+		}
+		if idle != kp.getIdleCnt() {
+			t.Error("The idle count of the key is ", kp.getIdleCnt(), " the lists hold ", idle)
+		}
+		keyCnt += idle
+	}
+
+	if keyCnt != p.shared.Len() || len(inShared) != p.shared.Len() {
+		t.Error("The key lists hold ", keyCnt, " elements, the global list ", p.shared.Len())
+	}
+}
+
+func TestPoolShrinkAnyPosition(t *testing.T) {
+	t.Log("TestPoolShrinkAnyPosition: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	p.Add("b", testFactory("b", &made))
+
+	var res []*testRes
+	for i := 0; i < 12; i++ {
+		key := "a"
+		if i%3 == 0 {
+			key = "b"
+		}
+		r, _ := p.Get(context.Background(), key)
+		res = append(res, r)
+	}
+	for _, r := range res {
+		p.Put(r.key, r)
+	}
+
+	//Reorder the global list only, so the global LRU tail
+	//is no longer at the back of its key list
+	p.lock.Lock()
+	var touched []*PoolElement[string, *testRes]
+	p.shared.Do(func(pe *PoolElement[string, *testRes]) {
+		if pe.SrvPool.key == "a" {
+			touched = append(touched, pe)
+		}
+	})
+	for i := len(touched) - 1; i >= 0; i-- {
+		p.shared.Remove(&touched[i].global)
+		p.shared.PushBackElement(&touched[i].global)
+	}
+	p.lock.Unlock()
+
+	for i := 0; i < 4; i++ {
+		r, _ := p.Get(context.Background(), "b")
+		res = append(res, r)
+		p.Put("b", r)
+	}
+	r, _ := p.Get(context.Background(), "a")
+	p.Put("a", r)
+
+	time.Sleep(5 * DefaultShrinkSpan * time.Millisecond)
+	if p.Len() > p.shrinkThreshold() {
+		t.Error("The pool count should be shrunk to the threshold, current count is ", p.Len())
+	}
+	checkPoolLists(t, p)
+
+	//Every idle resource can still be taken out
+	for p.IdleLen("a") > 0 {
+		r, _ := p.Get(context.Background(), "a")
+		if r.isClosed() {
+			t.Error("Get returned a shrunk resource")
+		}
+	}
+	for p.IdleLen("b") > 0 {
+		r, _ := p.Get(context.Background(), "b")
+		if r.isClosed() {
+			t.Error("Get returned a shrunk resource")
+		}
+	}
+	if p.Len() != 0 {
+		t.Error("The global list should be empty, count is ", p.Len())
+	}
+
+	t.Log("TestPoolShrinkAnyPosition: End Testing")
+}
+
+func TestPoolExpire(t *testing.T) {
+	t.Log("TestPoolExpire: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	p.Add("b", testFactory("b", &made))
+
+	idle1, _ := p.Get(context.Background(), "a")
+	idle2, _ := p.Get(context.Background(), "a")
+	inUse, _ := p.Get(context.Background(), "a")
+	other, _ := p.Get(context.Background(), "b")
+	p.Put("a", idle1)
+	p.Put("a", idle2)
+	p.Put("b", other)
+
+	p.Expire("a")
+	p.Expire("unknown")
+
+	//Checkout skips and closes the stale ones
+	r, _ := p.Get(context.Background(), "a")
+	if r == idle1 || r == idle2 || r.isClosed() {
+		t.Error("Get should not return a stale resource")
+	}
+	if !idle2.isClosed() {
+		t.Error("The stale resource met by Get should be closed")
+	}
+	p.Put("a", r)
+
+	//The one in use is closed when put back
+	p.Put("a", inUse)
+	if !inUse.isClosed() {
+		t.Error("The stale resource should be closed when put back")
+	}
+
+	//The shrink tick sweeps the rest
+	time.Sleep(3 * DefaultShrinkSpan * time.Millisecond)
+	if !idle1.isClosed() || p.IdleLen("a") != 1 {
+		t.Error("The shrink tick should close the stale resources, idle ", p.IdleLen("a"))
+	}
+	if other.isClosed() || p.IdleLen("b") != 1 {
+		t.Error("Expire should not touch other keys")
+	}
+	checkPoolLists(t, p)
+
+	t.Log("TestPoolExpire: End Testing")
+}
+
+func TestPoolEndpoints(t *testing.T) {
+	t.Log("TestPoolEndpoints: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var madeX, madeY int32
+	err := p.AddEndpoints("a", []Endpoint[*testRes]{
+		{Name: "x", Factory: testFactory("x", &madeX)},
+		{Name: "y", Factory: testFactory("y", &madeY)},
+		{Name: "x", Factory: testFactory("x", &madeX)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eps := p.Endpoints("a"); len(eps) != 2 || eps[0] != "x" || eps[1] != "y" {
+		t.Error("The duplicated endpoint should be dropped ", eps)
+	}
+
+	//New resources are spread over the endpoints
+	var res []*testRes
+	for i := 0; i < 4; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		res = append(res, r)
+	}
+	if atomic.LoadInt32(&madeX) != 2 || atomic.LoadInt32(&madeY) != 2 {
+		t.Error("Dials should be spread over the endpoints ", madeX, madeY)
+	}
+	p.Put("a", res[0])
+	p.Put("a", res[1])
+
+	//Removing y drains its idle resources, keeps the ones of x
+	p.SetEndpoints("a", []Endpoint[*testRes]{{Name: "x", Factory: testFactory("x", &madeX)}})
+	time.Sleep(10 * time.Millisecond)
+	for _, r := range res[:2] {
+		if r.key == "y" && (!r.isClosed() || p.IdleLen("a") != 1) {
+			t.Error("The idle resources of the removed endpoint should be closed")
+		}
+		if r.key == "x" && r.isClosed() {
+			t.Error("The idle resources of the kept endpoint should stay")
+		}
+	}
+	checkPoolLists(t, p)
+	if s, _ := p.Stats("a"); s.InUse != 2 {
+		t.Error("The resources of the removed endpoint should stay in use, in use ", s.InUse)
+	}
+
+	//The ones in use are closed when put back
+	for _, r := range res[2:] {
+		p.Put("a", r)
+		if r.key == "y" && !r.isClosed() {
+			t.Error("The resource of the removed endpoint should be closed when put back")
+		}
+	}
+	if p.IdleLen("a") != 2 {
+		t.Error("The resources of the kept endpoint should be pooled, idle ", p.IdleLen("a"))
+	}
+	if s, _ := p.Stats("a"); s.InUse != 0 {
+		t.Error("Nothing should be in use, in use ", s.InUse)
+	}
+
+	//No endpoint left
+	p.SetEndpoints("a", nil)
+	if _, err := p.Get(context.Background(), "a"); err == nil || err.Error() != ERROR_NO_ENDPOINT {
+		t.Error("Get without endpoint should fail, got ", err)
+	}
+	if p.Len() != 0 {
+		t.Error("Removing every endpoint should drain the key, count is ", p.Len())
+	}
+
+	t.Log("TestPoolEndpoints: End Testing")
+}
+
+func TestPoolDiscardCount(t *testing.T) {
+	t.Log("TestPoolDiscardCount: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	r1, _ := p.Get(context.Background(), "a")
+	r2, _ := p.Get(context.Background(), "a")
+	r3, _ := p.Get(context.Background(), "a")
+	p.Put("a", r1)
+	p.Discard(r2)
+
+	//One stale idle met by Get, one stale put back
+	p.Expire("a")
+	r, _ := p.Get(context.Background(), "a")
+	p.Put("a", r3)
+
+	if n := p.DiscardCount("a", DiscardCaller); n != 1 {
+		t.Error("Discard by the caller counted ", n)
+	}
+	if n := p.DiscardCount("a", DiscardStale); n != 2 {
+		t.Error("Discard of the stale ones counted ", n)
+	}
+	if p.DiscardCount("a", DiscardReason(-1)) != 0 || p.DiscardCount("b", DiscardCaller) != 0 {
+		t.Error("Unknown reason or key should count nothing")
+	}
+	p.Put("a", r)
+
+	t.Log("TestPoolDiscardCount: End Testing")
+}
+
+func TestPoolMaxUses(t *testing.T) {
+	t.Log("TestPoolMaxUses: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	var made int32
+	p.Add("a", testFactory("a", &made))
+	p.SetMaxUses("a", 3)
+
+	first, _ := p.Get(context.Background(), "a")
+	p.Put("a", first)
+	for i := 0; i < 2; i++ {
+		r, _ := p.Get(context.Background(), "a")
+		if r != first {
+			t.Error("Should reuse the resource before its max uses")
+		}
+		p.Put("a", r)
+	}
+	if !first.isClosed() || p.IdleLen("a") != 0 || p.DiscardCount("a", DiscardRetired) != 1 {
+		t.Error("The resource should be retired after its max uses")
+	}
+
+	r, _ := p.Get(context.Background(), "a")
+	if r == first || atomic.LoadInt32(&made) != 2 {
+		t.Error("A new resource should replace the retired one")
+	}
+	p.Put("a", r)
+
+	t.Log("TestPoolMaxUses: End Testing")
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package srv
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+//Check the idle connection by a read with a short deadline.
+//Closed by the peer or unexpected data means dead
+func probeConn(c net.Conn) error {
+	var buf [1]byte
+	c.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := c.Read(buf[:])
+	c.SetReadDeadline(time.Time{})
+
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	case err != nil:
+		return err
+	case n > 0:
+		return errors.New(ERROR_UNEXPECTED_DATA)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package srv
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+//Check the idle connection without waiting, by peeking at the socket.
+//Closed by the peer or unexpected data means dead, the tls records
+//sent after the handshake are left to the tls layer
+func probeConn(c net.Conn) error {
+	raw, isTLS := c, false
+	if tc, ok := c.(*tls.Conn); ok {
+		raw, isTLS = tc.NetConn(), true
+	}
+
+	sc, ok := raw.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var n int
+	var peekErr error
+	var buf [1]byte
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, peekErr = syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		//never wait for the socket to be readable
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case peekErr == syscall.EAGAIN || peekErr == syscall.EWOULDBLOCK:
+		return nil
+	case peekErr != nil:
+		return peekErr
+	case n == 0:
+		return io.EOF
+	case !isTLS:
+		return errors.New(ERROR_UNEXPECTED_DATA)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+const DefaultRetryBaseBackoff = 10 //Millisecond
+const DefaultRetryMaxBackoff = 1   //Second
+
+//Dial retry settings of a key, the retries are bounded by the Get context
+type RetryPolicy struct {
+	//dials including the first one, no retry if 1 or less
+	MaxAttempts int
+	//wait before the first retry, doubled on every retry, DefaultRetryBaseBackoff if 0
+	BaseBackoff time.Duration
+	//the wait never exceeds it, DefaultRetryMaxBackoff if 0
+	MaxBackoff time.Duration
+	//fraction in [0, 1] of the wait randomly added or taken
+	Jitter float64
+	//whether the dial error is worth a retry, every error but the context ones if nil
+	Retryable func(err error) bool
+}
+
+//Check whether both policies are the same, Retryable by whether it is set
+func (rp *RetryPolicy) same(other *RetryPolicy) bool {
+	if rp == nil || other == nil {
+		return rp == other
+	}
+
+	return rp.MaxAttempts == other.MaxAttempts && rp.BaseBackoff == other.BaseBackoff &&
+		rp.MaxBackoff == other.MaxBackoff && rp.Jitter == other.Jitter &&
+		(rp.Retryable == nil) == (other.Retryable == nil)
+}
+
+//Wait before the retry following the attempt, counted from 1
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	base, max := rp.BaseBackoff, rp.MaxBackoff
+	if base <= 0 {
+		base = DefaultRetryBaseBackoff * time.Millisecond
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff * time.Second
+	}
+
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	if jitter := rp.Jitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		d += time.Duration(float64(d) * jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+func (rp *RetryPolicy) retryable(err error) bool {
+	if rp.Retryable != nil {
+		return rp.Retryable(err)
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+//Create a resource by the factory, retried by the policy, no retry if nil.
+//The last dial error is returned once the attempts or the context are used up
+func dialRetry[R io.Closer](ctx context.Context, factory Factory[R], rp *RetryPolicy) (r R, err error) {
+	for attempt := 1; ; attempt++ {
+		r, err = factory(ctx)
+		if err == nil || rp == nil || attempt >= rp.MaxAttempts || !rp.retryable(err) {
+			return
+		}
+
+		timer := time.NewTimer(rp.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
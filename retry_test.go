@@ -0,0 +1,88 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	t.Log("TestRetryBackoff: Start Testing")
+	rp := &RetryPolicy{BaseBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	expect := []time.Duration{10, 20, 40, 50, 50}
+	for i, d := range expect {
+		if got := rp.backoff(i + 1); got != d*time.Millisecond {
+			t.Error("Backoff of attempt ", i+1, " is ", got, " expect ", d*time.Millisecond)
+		}
+	}
+
+	rp.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := rp.backoff(2); got < 10*time.Millisecond || got > 30*time.Millisecond {
+			t.Error("Jittered backoff out of range ", got)
+		}
+	}
+
+	if got := (&RetryPolicy{}).backoff(1); got != DefaultRetryBaseBackoff*time.Millisecond {
+		t.Error("Default backoff is ", got)
+	}
+
+	t.Log("TestRetryBackoff: End Testing")
+}
+
+func TestPoolDialRetry(t *testing.T) {
+	t.Log("TestPoolDialRetry: Start Testing")
+	p := NewPool[string, *testRes](10)
+	p.Start()
+	defer p.ShutDown()
+
+	refused := errors.New("refused")
+	var fails, dials int32
+	p.Add("a", func(ctx context.Context) (*testRes, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.AddInt32(&fails, -1) >= 0 {
+			return nil, refused
+		}
+		return &testRes{key: "a"}, nil
+	})
+	p.SetRetryPolicy("a", &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond})
+
+	//Absorb two failures
+	atomic.StoreInt32(&fails, 2)
+	if _, err := p.Get(context.Background(), "a"); err != nil || atomic.LoadInt32(&dials) != 3 {
+		t.Error("The failed dials should be retried ", err, dials)
+	}
+
+	//Give up after the attempts
+	atomic.StoreInt32(&fails, 5)
+	atomic.StoreInt32(&dials, 0)
+	if _, err := p.Get(context.Background(), "a"); err != refused || atomic.LoadInt32(&dials) != 3 {
+		t.Error("The last dial error should be returned after the attempts ", err, dials)
+	}
+
+	//Not retryable
+	p.SetRetryPolicy("a", &RetryPolicy{MaxAttempts: 3, Retryable: func(err error) bool { return false }})
+	atomic.StoreInt32(&fails, 5)
+	atomic.StoreInt32(&dials, 0)
+	if _, err := p.Get(context.Background(), "a"); err != refused || atomic.LoadInt32(&dials) != 1 {
+		t.Error("The error not retryable should be returned at once ", err, dials)
+	}
+
+	//Bounded by the context
+	p.SetRetryPolicy("a", &RetryPolicy{MaxAttempts: 100, BaseBackoff: 20 * time.Millisecond})
+	atomic.StoreInt32(&fails, 100)
+	atomic.StoreInt32(&dials, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.Get(ctx, "a"); err != refused || time.Since(start) > time.Second {
+		t.Error("The retry should stop with the context ", err, time.Since(start))
+	}
+	if n := atomic.LoadInt32(&dials); n < 2 || n > 4 {
+		t.Error("The retry should be bounded by the context, dials ", n)
+	}
+
+	t.Log("TestPoolDialRetry: End Testing")
+}
@@ -0,0 +1,88 @@
+package srv
+
+import (
+	"net"
+	"time"
+)
+
+//Socket options of the tcp connections of a server, applied right after the dial
+type SocketOptions struct {
+	//idle time before the first keepalive probe as net.Dialer takes it,
+	//the Go default if 0, no keepalive if negative
+	KeepAlive time.Duration
+	//time between the keepalive probes and how many unanswered drop the connection,
+	//the system default if 0. Linux only, ignored elsewhere
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	//keep Nagle's algorithm on, Go turns it off by default
+	Delay bool
+	//kernel buffer sizes, the system default if 0
+	ReadBuffer  int
+	WriteBuffer int
+	//seconds to linger on close as TCPConn.SetLinger takes them, the system default if nil
+	Linger *int
+	//how long sent data may stay unacknowledged before the connection is dropped,
+	//the system default if 0. Linux only, ignored elsewhere
+	UserTimeout time.Duration
+}
+
+//Apply the socket options to the dialed connections of the server
+func WithSocketOptions(opts SocketOptions) ServerOption {
+	return func(cp *ConnPool) {
+		cp.sockOpts = &opts
+	}
+}
+
+//Check whether both options are the same
+func (opts *SocketOptions) same(other *SocketOptions) bool {
+	if opts == nil || other == nil {
+		return opts == other
+	}
+
+	a, b := *opts, *other
+	if (a.Linger == nil) != (b.Linger == nil) || a.Linger != nil && *a.Linger != *b.Linger {
+		return false
+	}
+	a.Linger, b.Linger = nil, nil
+	return a == b
+}
+
+//The dialer of the raw connections
+func (opts *SocketOptions) dialer() *net.Dialer {
+	d := &net.Dialer{}
+	if opts != nil {
+		d.KeepAlive = opts.KeepAlive
+	}
+	return d
+}
+
+//Apply the options other than the keepalive idle time to the dialed connection,
+//nothing to do for the connections other than tcp
+func (opts *SocketOptions) apply(c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if opts == nil || !ok {
+		return nil
+	}
+
+	if opts.Delay {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if opts.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(opts.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(opts.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.Linger != nil {
+		if err := tc.SetLinger(*opts.Linger); err != nil {
+			return err
+		}
+	}
+	return opts.applySys(tc)
+}
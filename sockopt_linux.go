@@ -0,0 +1,54 @@
+package srv
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+//TCP_USER_TIMEOUT of linux/tcp.h, not in the syscall package
+const tcpUserTimeout = 0x12
+
+//Set the linux only options of the connection
+func (opts *SocketOptions) applySys(tc *net.TCPConn) error {
+	var sockOpts [][2]int
+	if opts.KeepAlive >= 0 && opts.KeepAliveInterval > 0 {
+		sockOpts = append(sockOpts, [2]int{syscall.TCP_KEEPINTVL, roundSeconds(opts.KeepAliveInterval)})
+	}
+	if opts.KeepAlive >= 0 && opts.KeepAliveCount > 0 {
+		sockOpts = append(sockOpts, [2]int{syscall.TCP_KEEPCNT, opts.KeepAliveCount})
+	}
+	if opts.UserTimeout > 0 {
+		sockOpts = append(sockOpts, [2]int{tcpUserTimeout, int(opts.UserTimeout / time.Millisecond)})
+	}
+	if len(sockOpts) == 0 {
+		return nil
+	}
+
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		for _, opt := range sockOpts {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt[0], opt[1]); sockErr != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+//Whole seconds of the duration, at least one
+func roundSeconds(d time.Duration) int {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
@@ -0,0 +1,79 @@
+package srv
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//Read a socket option of the connection
+func getSockOpt(t *testing.T, c net.Conn, level, opt int) int {
+	t.Helper()
+	rc, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v int
+	var sockErr error
+	rc.Control(func(fd uintptr) {
+		v, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return v
+}
+
+func TestSocketOptions(t *testing.T) {
+	t.Log("TestSocketOptions: Start Testing")
+	l := newTestListener(t, "127.0.0.1:0")
+
+	cm := NewConnMap(DEFAULT_CONNMAP_CAP)
+	cm.Start()
+	defer cm.ShutDown()
+
+	linger := 0
+	cm.AddServer(1, l.Addr().String(), WithSocketOptions(SocketOptions{
+		KeepAlive:         time.Minute,
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveCount:    4,
+		Delay:             true,
+		ReadBuffer:        64 << 10,
+		Linger:            &linger,
+		UserTimeout:       30 * time.Second,
+	}))
+	cm.AddServer(2, l.Addr().String())
+
+	c, err := cm.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getSockOpt(t, c, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Error("Nagle's algorithm should be on")
+	}
+	if getSockOpt(t, c, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 ||
+		getSockOpt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE) != 60 ||
+		getSockOpt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL) != 10 ||
+		getSockOpt(t, c, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT) != 4 {
+		t.Error("The keepalive options are not applied")
+	}
+	if getSockOpt(t, c, syscall.SOL_SOCKET, syscall.SO_RCVBUF) < 64<<10 {
+		t.Error("The read buffer is not applied")
+	}
+	if getSockOpt(t, c, syscall.IPPROTO_TCP, tcpUserTimeout) != 30000 {
+		t.Error("The user timeout is not applied")
+	}
+
+	//The Go defaults
+	c2, err := cm.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getSockOpt(t, c2, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Error("Nagle's algorithm should be off by default")
+	}
+
+	t.Log("TestSocketOptions: End Testing")
+}
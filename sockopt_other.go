@@ -0,0 +1,12 @@
+//go:build !linux
+
+package srv
+
+import (
+	"net"
+)
+
+//The keepalive interval and count and the user timeout are linux only
+func (opts *SocketOptions) applySys(tc *net.TCPConn) error {
+	return nil
+}
@@ -0,0 +1,239 @@
+package srv
+
+import (
+	"errors"
+	"time"
+)
+
+const DefaultDialErrorHistory = 10
+
+//Snapshot of one key of the pool
+type KeyStats struct {
+	//idle resources
+	Idle int
+	//resources checked out or being created
+	InUse int
+	//names of the endpoints
+	Endpoints []string
+	Circuit   CircuitState
+	//what the idle monitor found
+	IdleHealth IdleHealth
+	//resources closed instead of pooled, by reason
+	Discards map[DiscardReason]uint64
+	//when the least recently returned idle resource was returned, zero if none idle
+	OldestIdle time.Time
+	//the last dial errors, the oldest first
+	DialErrors []DialError
+}
+
+//A failed dial of a key
+type DialError struct {
+	Time     time.Time
+	Endpoint string
+	Err      error
+}
+
+//What the shrink did so far
+type ShrinkStats struct {
+	//shrink ticks run
+	Runs uint64
+	//idle resources closed to keep the pool under the threshold
+	Closed uint64
+	//when the last tick ran and how many it closed
+	LastRun    time.Time
+	LastClosed int
+	//the idle count the shrink keeps the pool under
+	Threshold int
+}
+
+//Keep the dial error, the caller must hold the Pool lock
+func (kp *KeyPool[K, R]) recordDialError(endpoint string, err error) {
+	if len(kp.dialErrors) >= DefaultDialErrorHistory {
+		copy(kp.dialErrors, kp.dialErrors[1:])
+		kp.dialErrors = kp.dialErrors[:len(kp.dialErrors)-1]
+	}
+	kp.dialErrors = append(kp.dialErrors, DialError{Time: time.Now(), Endpoint: endpoint, Err: err})
+}
+
+//What the shrink did so far
+func (p *Pool[K, R]) ShrinkStats() ShrinkStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := p.shrinkStats
+	stats.Threshold = p.shrinkThreshold()
+	return stats
+}
+
+//Count a shrink run closing the taken list, the caller must hold the lock
+func (p *Pool[K, R]) recordShrink(clearList *List[*PoolElement[K, R]]) {
+	p.shrinkStats.Runs++
+	p.shrinkStats.LastRun = time.Now()
+	p.shrinkStats.LastClosed = 0
+	if clearList != nil {
+		p.shrinkStats.LastClosed = clearList.Len()
+		p.shrinkStats.Closed += uint64(clearList.Len())
+	}
+}
+
+//Close the idle resources over the count now, chosen by the eviction policy
+//and counted as the shrink does, and return how many were closed
+func (p *Pool[K, R]) ShrinkTo(idle int) int {
+	if idle < 0 {
+		idle = 0
+	}
+
+	p.lock.Lock()
+	if !p.isAvaliable {
+		p.lock.Unlock()
+		return 0
+	}
+	clearList := p.takeShrink(p.shared.Len() - idle)
+	p.recordShrink(clearList)
+	p.lock.Unlock()
+
+	if clearList == nil {
+		return 0
+	}
+	n := clearList.Len()
+	p.closeAll(clearList)
+	return n
+}
+
+//Snapshot of the key, false if the key does not exist
+func (p *Pool[K, R]) Stats(key K) (stats KeyStats, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kp := p.keys[key]
+	if kp == nil {
+		return stats, false
+	}
+
+	stats.Idle = kp.getIdleCnt()
+	stats.InUse = kp.inUse
+	stats.Endpoints = make([]string, 0, len(kp.endpoints))
+	for _, ep := range kp.endpoints {
+		stats.Endpoints = append(stats.Endpoints, ep.name)
+		//the idle list is ordered from the most to the least recently returned
+		if back := ep.list.Back(); ep.list.Len() > 0 {
+			if returned := back.Value.returned; stats.OldestIdle.IsZero() || returned.Before(stats.OldestIdle) {
+				stats.OldestIdle = returned
+			}
+		}
+	}
+	if kp.breaker != nil {
+		stats.Circuit = kp.breaker.state
+	}
+	stats.IdleHealth = kp.health
+	stats.DialErrors = append([]DialError(nil), kp.dialErrors...)
+	stats.Discards = make(map[DiscardReason]uint64, discardReasons)
+	for reason, n := range kp.discards {
+		if n > 0 {
+			stats.Discards[DiscardReason(reason)] = n
+		}
+	}
+	return stats, true
+}
+
+//Snapshot of one server of the connect map
+type ServerInfo struct {
+	ID      uint16
+	Network string
+	//the addresses the server was added with
+	Addrs []string
+	TLS   bool
+	//the pool of the server, Endpoints hold the resolved addresses
+	KeyStats
+	Health ServerHealth
+}
+
+//Snapshot of every server, ordered by id
+func (p *ConnMap) Servers() []ServerInfo {
+	p.lock.Lock()
+	var cps []*ConnPool
+	for _, cp := range p.cm {
+		if cp != nil {
+			cps = append(cps, cp)
+		}
+	}
+	p.lock.Unlock()
+
+	infos := make([]ServerInfo, 0, len(cps))
+	for _, cp := range cps {
+		if info, ok := p.serverInfo(cp); ok {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+//Snapshot of the server
+func (p *ConnMap) Server(id uint16) (info ServerInfo, err error) {
+	if id >= DefaultMaxServers {
+		err = errors.New(ERROR_WRONG_SERVER_ID)
+		return
+	}
+
+	p.lock.Lock()
+	cp := p.cm[id]
+	p.lock.Unlock()
+	if cp == nil {
+		err = errors.New(ERROR_NO_EXIST_SERVER)
+		return
+	}
+
+	info, ok := p.serverInfo(cp)
+	if !ok {
+		err = errors.New(ERROR_NO_EXIST_SERVER)
+	}
+	return
+}
+
+//Snapshot of the server, false if it was deleted meanwhile
+func (p *ConnMap) serverInfo(cp *ConnPool) (info ServerInfo, ok bool) {
+	stats, ok := p.pool.Stats(cp.id)
+	if !ok {
+		return info, false
+	}
+
+	info = ServerInfo{
+		ID:       cp.id,
+		Network:  cp.network,
+		Addrs:    make([]string, 0, len(cp.addrs)),
+		KeyStats: stats,
+	}
+	for _, a := range cp.addrs {
+		info.Addrs = append(info.Addrs, a.addr)
+	}
+
+	cp.lock.Lock()
+	info.TLS = cp.tlsConfig != nil
+	info.Health = cp.health
+	cp.lock.Unlock()
+	return info, true
+}
+
+//What the shrink did so far
+func (p *ConnMap) ShrinkStats() ShrinkStats {
+	return p.pool.ShrinkStats()
+}
+
+//Close the idle connections over the count now, see Pool.ShrinkTo
+func (p *ConnMap) ShrinkTo(idle int) int {
+	return p.pool.ShrinkTo(idle)
+}
+
+//Close the idle connections of the server and keep the server
+func (p *ConnMap) DrainServer(id uint16) error {
+	if id >= DefaultMaxServers {
+		return errors.New(ERROR_WRONG_SERVER_ID)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.cm[id] == nil {
+		return errors.New(ERROR_NO_EXIST_SERVER)
+	}
+
+	p.pool.Drain(id)
+	return nil
+}